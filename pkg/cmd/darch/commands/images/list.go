@@ -3,7 +3,11 @@ package images
 import (
 	"context"
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/repository"
 	"github.com/urfave/cli"
 )
@@ -11,9 +15,18 @@ import (
 var listCommand = cli.Command{
 	Name:  "list",
 	Usage: "list images",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "details, d",
+			Usage: "show the size and creation time of each image",
+		},
+	},
 	Action: func(clicontext *cli.Context) error {
+		var (
+			details = clicontext.Bool("details")
+		)
 
-		repo, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
+		repo, err := commands.NewSession(clicontext)
 		if err != nil {
 			return err
 		}
@@ -24,10 +37,22 @@ var listCommand = cli.Command{
 			return err
 		}
 
-		for _, img := range imgs {
-			fmt.Println(img.Name + ":" + img.Tag)
+		if !details {
+			for _, img := range imgs {
+				fmt.Println(img.FullName())
+			}
+			return nil
 		}
 
-		return nil
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tSIZE\tCREATED")
+		for _, img := range imgs {
+			size := "unknown"
+			if img.Size != repository.SizeUnknown {
+				size = fmt.Sprintf("%.1f MiB", float64(img.Size)/(1<<20))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", img.FullName(), size, img.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
 	},
 }
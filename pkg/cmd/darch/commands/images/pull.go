@@ -3,6 +3,7 @@ package images
 import (
 	ctx "context"
 	"fmt"
+	"os"
 
 	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/reference"
@@ -25,12 +26,12 @@ var pullCommand = cli.Command{
 			return err
 		}
 
-		resolver, err := commands.GetResolver(clicontext)
+		registryOptions, err := commands.GetRegistryOptions(clicontext)
 		if err != nil {
 			return err
 		}
 
-		repo, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
+		repo, err := commands.NewSession(clicontext)
 		if err != nil {
 			return err
 		}
@@ -38,7 +39,10 @@ var pullCommand = cli.Command{
 
 		fmt.Printf("pulling %s\n", imageRef.FullName())
 
-		err = repo.Pull(ctx.Background(), imageRef, resolver)
+		err = repo.PullImage(ctx.Background(), imageRef, repository.PullOptions{
+			RegistryOptions: registryOptions,
+			Progress:        os.Stdout,
+		})
 		if err != nil {
 			return err
 		}
@@ -3,8 +3,8 @@ package images
 import (
 	"context"
 
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/reference"
-	"github.com/godarch/darch/pkg/repository"
 	"github.com/urfave/cli"
 )
 
@@ -19,16 +19,16 @@ var removeCommand = cli.Command{
 
 		ref, err := reference.ParseImage(image)
 		if err != nil {
-			return nil
+			return err
 		}
 
-		repo, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
+		repo, err := commands.NewSession(clicontext)
 		if err != nil {
 			return err
 		}
 		defer repo.Close()
 
-		err = repo.RemoveImage(context.Background(), ref.FullName())
+		err = repo.RemoveImage(context.Background(), ref)
 		if err != nil {
 			return err
 		}
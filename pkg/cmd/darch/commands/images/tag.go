@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/reference"
-	"github.com/godarch/darch/pkg/repository"
 	"github.com/urfave/cli"
 )
 
@@ -32,7 +32,7 @@ var tagCommand = cli.Command{
 			return err
 		}
 
-		repo, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
+		repo, err := commands.NewSession(clicontext)
 		if err != nil {
 			return err
 		}
@@ -3,8 +3,10 @@ package recipes
 import (
 	"context"
 	"fmt"
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/recipes"
 	"github.com/godarch/darch/pkg/repository"
+	"github.com/godarch/darch/pkg/utils"
 	"github.com/urfave/cli"
 	"strings"
 )
@@ -13,7 +15,7 @@ var buildCommand = cli.Command{
 	Name:      "build",
 	Usage:     "build a recipe(s)",
 	ArgsUsage: "<recipes>",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "tags, t",
 			Usage: "the tag(s) to use when building the recipe",
@@ -27,13 +29,75 @@ var buildCommand = cli.Command{
 		cli.StringSliceFlag{
 			Name: "environment, e",
 		},
-	},
+		cli.StringFlag{
+			Name:  "prepare-check",
+			Usage: "a command that must succeed (in a new container on the prepared image) before the recipe is ran, retried until it does",
+		},
+		cli.DurationFlag{
+			Name:  "prepare-check-timeout",
+			Usage: "how long to wait for the prepare check to succeed",
+			Value: repository.DefaultPrepareCheckTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "build the recipes, even if nothing has changed",
+		},
+		cli.StringFlag{
+			Name:  "state-file",
+			Usage: "a file to record the completed recipes in, so that a failed build can be resumed",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "skip the recipes that the state file says are already completed",
+		},
+		cli.StringSliceFlag{
+			Name:  "trusted-digest",
+			Usage: "only build on external images with the given digest(s)",
+		},
+		cli.BoolFlag{
+			Name:  "pull",
+			Usage: "pull the external images the recipes inherit from, if they don't exist locally",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "the number of times to retry pulling and committing images, if they fail",
+		},
+		cli.StringFlag{
+			Name:  "package-cache",
+			Usage: "a directory to cache downloaded packages in, between builds",
+		},
+		cli.BoolFlag{
+			Name:  "package-cache-per-recipe",
+			Usage: "give each recipe its own directory in the package cache",
+		},
+		cli.StringSliceFlag{
+			Name:  "secret",
+			Usage: "a file (source:target) to mount while the recipe scripts run, that isn't kept in the image",
+		},
+		cli.IntFlag{
+			Name:  "concurrency, c",
+			Usage: "the number of recipes that can be built at the same time",
+			Value: 1,
+		},
+	}, commands.RegistryFlags...),
 	Action: func(clicontext *cli.Context) error {
 		var (
 			tags        = clicontext.String("tags")
 			imagePrefix = clicontext.String("image-prefix")
 			recipeNames = clicontext.Args()
-			env         = clicontext.StringSlice("env")
+			env         = clicontext.StringSlice("environment")
+			concurrency = clicontext.Int("concurrency")
+			check       = clicontext.String("prepare-check")
+			timeout     = clicontext.Duration("prepare-check-timeout")
+			force       = clicontext.Bool("force")
+			stateFile   = clicontext.String("state-file")
+			resume      = clicontext.Bool("resume")
+			trusted     = clicontext.StringSlice("trusted-digest")
+			cache       = clicontext.String("package-cache")
+			cacheScoped = clicontext.Bool("package-cache-per-recipe")
+			pull        = clicontext.Bool("pull")
+			retries     = clicontext.Int("retries")
+			secretVals  = clicontext.StringSlice("secret")
 		)
 
 		if len(recipeNames) == 0 {
@@ -57,35 +121,71 @@ var buildCommand = cli.Command{
 			}
 		}
 
-		session, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
-		if err != nil {
-			return err
+		var trustPolicy *repository.TrustPolicy
+		if len(trusted) > 0 {
+			trustPolicy, err = repository.ParseTrustPolicy(trusted)
+			if err != nil {
+				return err
+			}
 		}
 
-		// Now, let's go through each recipe and build it.
-		for _, recipeName := range recipeNames {
-			fmt.Printf("building %s...\n", recipeName)
-			image, err := session.BuildRecipe(context.Background(), allRecipes[recipeName], defaultTag, imagePrefix, env)
+		secrets := make([]repository.BuildSecret, 0, len(secretVals))
+		for _, secretVal := range secretVals {
+			secret, err := repository.ParseBuildSecret(secretVal)
 			if err != nil {
 				return err
 			}
-			fmt.Printf("built %s as %s\n", recipeName, image.FullName())
-			// Add additional tags.
-			if len(additionalTags) > 0 {
-				for _, tag := range additionalTags {
-					newImageRef, err := image.WithTag(tag)
-					if err != nil {
-						return err
-					}
-					fmt.Printf("tagging as %s\n", newImageRef.FullName())
-					err = session.TagImage(context.Background(), image, newImageRef)
-					if err != nil {
-						return err
-					}
-				}
+			secrets = append(secrets, secret)
+		}
+
+		var registryOptions repository.RegistryOptions
+		if pull {
+			registryOptions, err = commands.GetRegistryOptions(clicontext)
+			if err != nil {
+				return err
 			}
 		}
 
+		session, err := commands.NewSession(clicontext)
+		if err != nil {
+			return err
+		}
+
+		toBuild := make([]recipes.Recipe, 0)
+		for _, recipeName := range utils.RemoveDuplicates(recipeNames) {
+			fmt.Printf("building %s...\n", recipeName)
+			toBuild = append(toBuild, allRecipes[recipeName])
+		}
+
+		ctx, done := commands.CancelOnSignal(context.Background())
+		defer done()
+
+		builtImages, err := session.BuildRecipes(ctx, toBuild, repository.BuildOptions{
+			Tag:                   defaultTag,
+			AdditionalTags:        additionalTags,
+			ImagePrefix:           imagePrefix,
+			Env:                   env,
+			PrepareCheck:          check,
+			PrepareCheckTimeout:   timeout,
+			Force:                 force,
+			StateFile:             stateFile,
+			Resume:                resume,
+			TrustPolicy:           trustPolicy,
+			PackageCache:          cache,
+			PackageCachePerRecipe: cacheScoped,
+			PullExternal:          pull,
+			Registry:              registryOptions,
+			Retries:               retries,
+			Secrets:               secrets,
+		}, concurrency)
+		if err != nil {
+			return err
+		}
+
+		for i, image := range builtImages {
+			fmt.Printf("built %s as %s\n", toBuild[i].Name, image.FullName())
+		}
+
 		return err
 	},
 }
@@ -2,6 +2,7 @@ package recipes
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/godarch/darch/pkg/recipes"
 	"github.com/urfave/cli"
@@ -10,7 +11,17 @@ import (
 var listCommand = cli.Command{
 	Name:  "list",
 	Usage: "list all recipes",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "list the recipes (in build order) as json",
+		},
+	},
 	Action: func(clicontext *cli.Context) error {
+		if clicontext.Bool("json") {
+			return recipes.WriteJSON(getRecipesDir(clicontext), os.Stdout)
+		}
+
 		rs, err := recipes.GetAllRecipes(getRecipesDir(clicontext))
 		if err != nil {
 			return err
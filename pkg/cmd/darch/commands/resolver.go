@@ -2,17 +2,12 @@ package commands
 
 import (
 	"bufio"
-	"crypto/tls"
 	"fmt"
 	"github.com/containerd/console"
-	"github.com/containerd/containerd/remotes"
-	"github.com/containerd/containerd/remotes/docker"
+	"github.com/godarch/darch/pkg/repository"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	"net"
-	"net/http"
 	"strings"
-	"time"
 )
 
 var (
@@ -37,17 +32,14 @@ var (
 	}
 )
 
-// GetResolver prepares the resolver from the environment and options
-func GetResolver(clicontext *cli.Context) (remotes.Resolver, error) {
+// GetRegistryOptions prepares the registry options from the environment and options
+func GetRegistryOptions(clicontext *cli.Context) (repository.RegistryOptions, error) {
 	username := clicontext.String("user")
 	var secret string
 	if i := strings.IndexByte(username, ':'); i > 0 {
 		secret = username[i+1:]
 		username = username[0:i]
 	}
-	options := docker.ResolverOptions{
-		PlainHTTP: clicontext.Bool("plain-http"),
-	}
 	if username != "" {
 		if secret == "" {
 			fmt.Printf("Password: ")
@@ -55,7 +47,7 @@ func GetResolver(clicontext *cli.Context) (remotes.Resolver, error) {
 			var err error
 			secret, err = passwordPrompt()
 			if err != nil {
-				return nil, err
+				return repository.RegistryOptions{}, err
 			}
 
 			fmt.Print("\n")
@@ -64,32 +56,12 @@ func GetResolver(clicontext *cli.Context) (remotes.Resolver, error) {
 		secret = rt
 	}
 
-	options.Credentials = func(host string) (string, string, error) {
-		// Only one host
-		return username, secret, nil
-	}
-
-	tr := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:        10,
-		IdleConnTimeout:     30 * time.Second,
-		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: clicontext.Bool("insecure"),
-		},
-		ExpectContinueTimeout: 5 * time.Second,
-	}
-
-	options.Client = &http.Client{
-		Transport: tr,
-	}
-
-	return docker.NewResolver(options), nil
+	return repository.RegistryOptions{
+		Username:   username,
+		Password:   secret,
+		PlainHTTP:  clicontext.Bool("plain-http"),
+		SkipVerify: clicontext.Bool("skip-verify"),
+	}, nil
 }
 
 func passwordPrompt() (string, error) {
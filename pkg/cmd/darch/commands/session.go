@@ -0,0 +1,38 @@
+package commands
+
+import (
+	"github.com/containerd/containerd"
+	"github.com/godarch/darch/pkg/repository"
+	"github.com/urfave/cli"
+)
+
+var (
+	// SessionFlags Global flags for connecting to containerd
+	SessionFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "address",
+			Usage:  "the address of the containerd socket",
+			Value:  repository.DefaultContainerdSocketLocation,
+			EnvVar: "DARCH_CONTAINERD_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "namespace",
+			Usage:  "the containerd namespace to keep images in",
+			Value:  repository.DefaultNamespace,
+			EnvVar: "DARCH_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "snapshotter",
+			Usage:  "the containerd snapshotter to use (overlayfs, btrfs, etc)",
+			Value:  containerd.DefaultSnapshotter,
+			EnvVar: "DARCH_SNAPSHOTTER",
+		},
+	}
+)
+
+// NewSession Creates a repository session, using the global flags.
+func NewSession(clicontext *cli.Context) (*repository.Session, error) {
+	return repository.NewSession(clicontext.GlobalString("address"),
+		repository.WithNamespace(clicontext.GlobalString("namespace")),
+		repository.WithSnapshotterName(clicontext.GlobalString("snapshotter")))
+}
@@ -14,6 +14,7 @@ var (
 			listCommand,
 			uploadCommand,
 			removeCommand,
+			verifyCommand,
 			tagCommand,
 			runHooksCommand,
 			syncBootloaderCommand,
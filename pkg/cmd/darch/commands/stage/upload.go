@@ -20,11 +20,33 @@ var uploadCommand = cli.Command{
 			Name:  "force",
 			Usage: "overwrite existing image with the given name",
 		},
+		cli.StringFlag{
+			Name:  "squashfs-compression",
+			Usage: "the compressor mksquashfs uses for the rootfs (gzip, lz4, xz, zstd, etc)",
+		},
+		cli.IntFlag{
+			Name:  "squashfs-compression-level",
+			Usage: "the compression level, for the compressors that have one",
+		},
+		cli.IntFlag{
+			Name:  "squashfs-block-size",
+			Usage: "the block size (in bytes) of the rootfs",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "sign the staged files with the gpg private key in the given file",
+		},
 	},
 	Action: func(clicontext *cli.Context) error {
 		var (
 			imageName = clicontext.Args().First()
 			force     = clicontext.Bool("force")
+			signKey   = clicontext.String("sign-key")
+			squashFS  = repository.SquashFSOptions{
+				Compression:      clicontext.String("squashfs-compression"),
+				CompressionLevel: clicontext.Int("squashfs-compression-level"),
+				BlockSize:        clicontext.Int("squashfs-block-size"),
+			}
 		)
 
 		err := commands.CheckForRoot()
@@ -37,7 +59,7 @@ var uploadCommand = cli.Command{
 			return err
 		}
 
-		repo, err := repository.NewSession(repository.DefaultContainerdSocketLocation)
+		repo, err := commands.NewSession(clicontext)
 		if err != nil {
 			return err
 		}
@@ -54,7 +76,13 @@ var uploadCommand = cli.Command{
 		}
 		defer ws.Destroy()
 
-		err = repo.ExtractImage(context.Background(), imageRef, ws.Path)
+		ctx, done := commands.CancelOnSignal(context.Background())
+		defer done()
+
+		err = repo.ExtractImage(ctx, imageRef, ws.Path, repository.ExtractOptions{
+			SquashFS:   squashFS,
+			SigningKey: signKey,
+		})
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,61 @@
+package stage
+
+import (
+	"fmt"
+
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
+	"github.com/godarch/darch/pkg/reference"
+	"github.com/godarch/darch/pkg/repository"
+	"github.com/godarch/darch/pkg/staging"
+	"github.com/urfave/cli"
+)
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify the files of a staged image were signed (see upload --sign-key)",
+	ArgsUsage: "<image[:tag]>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "public-key",
+			Usage: "the file with the gpg public key the files must be signed with",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		var (
+			imageName = clicontext.Args().First()
+			publicKey = clicontext.String("public-key")
+		)
+
+		if len(publicKey) == 0 {
+			return fmt.Errorf("a public key must be given")
+		}
+
+		err := commands.CheckForRoot()
+		if err != nil {
+			return err
+		}
+
+		imageRef, err := reference.ParseImage(imageName)
+		if err != nil {
+			return err
+		}
+
+		stagingSession, err := staging.NewSession()
+		if err != nil {
+			return err
+		}
+
+		imageDir, err := stagingSession.GetImageDir(imageRef)
+		if err != nil {
+			return err
+		}
+
+		err = repository.VerifyArtifacts(imageDir, publicKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s is signed\n", imageRef.FullName())
+		return nil
+	},
+}
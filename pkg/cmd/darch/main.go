@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/godarch/darch/pkg/cmd/darch/commands"
 	"github.com/godarch/darch/pkg/cmd/darch/commands/helpers"
 	"github.com/godarch/darch/pkg/cmd/darch/commands/hooks"
 	"github.com/godarch/darch/pkg/cmd/darch/commands/images"
@@ -25,6 +26,7 @@ func main() {
 	app.Usage = "A tool used to build, boot and share stateless Arch images."
 	app.Version = Version
 	app.HideVersion = true
+	app.Flags = commands.SessionFlags
 	app.Commands = []cli.Command{
 		images.Command,
 		recipes.Command,
@@ -0,0 +1,188 @@
+package recipes
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+// IgnoreFile The file in a recipe's directory listing the paths
+// (gitignore-style) that builds shouldn't see.
+const IgnoreFile = ".darchignore"
+
+type ignorePattern struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	// matchAnyDepth The pattern started with "**/", so it matches
+	// the end of a path, in any directory.
+	matchAnyDepth bool
+}
+
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// loadIgnoreMatcher Loads the .darchignore of a directory.
+// If there isn't one, nothing is ignored.
+func loadIgnoreMatcher(dir string) (*ignoreMatcher, error) {
+	matcher := &ignoreMatcher{}
+
+	ignoreFile := path.Join(dir, IgnoreFile)
+	if !utils.FileExists(ignoreFile) {
+		return matcher, nil
+	}
+
+	lines, err := utils.GetFileLines(ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.HasPrefix(line, "**/") {
+			p.matchAnyDepth = true
+			line = strings.TrimPrefix(line, "**/")
+		} else if strings.HasPrefix(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		} else if strings.Contains(line, "/") {
+			// Like git, patterns with a slash in the middle are relative to the directory.
+			p.anchored = true
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if _, err = filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s in %s: %v", line, ignoreFile, err)
+		}
+		p.pattern = line
+		matcher.patterns = append(matcher.patterns, p)
+	}
+
+	return matcher, nil
+}
+
+// ignored Returns true if the path (relative to the directory) should be ignored.
+// The last pattern that matches wins, so "!" patterns can include paths again.
+func (matcher *ignoreMatcher) ignored(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(relPath)
+	result := false
+	for _, p := range matcher.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var matched bool
+		switch {
+		case p.matchAnyDepth:
+			matched = matchAnyDepth(p.pattern, relPath)
+		case p.anchored:
+			matched, _ = filepath.Match(p.pattern, relPath)
+		default:
+			matched, _ = filepath.Match(p.pattern, path.Base(relPath))
+		}
+		if matched {
+			result = !p.negate
+		}
+	}
+	return result
+}
+
+// matchAnyDepth Returns true if the pattern matches the path, or the
+// end of it (starting at any directory), like "**/" does in git.
+func matchAnyDepth(pattern string, relPath string) bool {
+	for {
+		if matched, _ := filepath.Match(pattern, relPath); matched {
+			return true
+		}
+		i := strings.Index(relPath, "/")
+		if i < 0 {
+			return false
+		}
+		relPath = relPath[i+1:]
+	}
+}
+
+// walkRecipeDir Walks a recipe directory, skipping what its .darchignore ignores.
+func walkRecipeDir(dir string, walkFn func(filePath string, relPath string, info os.FileInfo) error) error {
+	matcher, err := loadIgnoreMatcher(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		if relPath != "." && matcher.ignored(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return walkFn(filePath, relPath, info)
+	})
+}
+
+// StageRecipe Copies the directory of the recipe, and the directories of its
+// mixins, to the destination, leaving out what their .darchignore files ignore.
+// The destination can then be given to builds in place of the recipes directory.
+func StageRecipe(recipe Recipe, destination string) error {
+	recipeNames := append([]string{recipe.Name}, recipe.Mixins...)
+
+	for _, recipeName := range utils.RemoveDuplicates(recipeNames) {
+		src := path.Join(recipe.RecipesDir, recipeName)
+		dst := path.Join(destination, recipeName)
+
+		err := walkRecipeDir(src, func(filePath string, relPath string, info os.FileInfo) error {
+			destPath := path.Join(dst, relPath)
+			switch {
+			case info.IsDir():
+				if err := os.MkdirAll(destPath, os.ModePerm); err != nil {
+					return err
+				}
+				return os.Chmod(destPath, info.Mode().Perm())
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(filePath)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(target, destPath)
+			case info.Mode().IsRegular():
+				return utils.CopyFile(filePath, destPath)
+			default:
+				// Sockets, devices, etc have no place in a recipe.
+				return nil
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
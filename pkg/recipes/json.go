@@ -0,0 +1,149 @@
+package recipes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+// recipeListing How a recipe is described by WriteJSON.
+// The fields are serialized in this order.
+type recipeListing struct {
+	Name             string   `json:"name"`
+	RecipeDir        string   `json:"recipeDir"`
+	Inherits         string   `json:"inherits"`
+	InheritsExternal bool     `json:"inheritsExternal"`
+	Mixins           []string `json:"mixins"`
+	// Order The position of the recipe in the build order.
+	Order int `json:"order"`
+	// Depth How many recipes are between this one and the external image it
+	// ultimately inherits from (0 if it inherits an external image directly).
+	// Cyclical recipes have no depth, they are given CyclicalDepth.
+	Depth int `json:"depth"`
+	// MissingParent The recipe inherits from (or mixes in) a recipe that doesn't exist.
+	MissingParent bool `json:"missingParent"`
+	// Cyclical The recipe depends on itself, or inherits from a recipe that does.
+	Cyclical bool `json:"cyclical"`
+	// ConfigError Why the configuration of the recipe couldn't be loaded, if it couldn't.
+	// Only its name and directory are known then.
+	ConfigError string `json:"configError"`
+}
+
+// CyclicalDepth The depth WriteJSON gives recipes that are cyclical.
+const CyclicalDepth = -1
+
+// WriteJSON Writes all the recipes in a recipe directory as a JSON array, in build order.
+// Unlike GetAllRecipes, recipes with missing parents, cyclical dependencies or invalid
+// configurations aren't an error, they are flagged instead, so partially broken trees can be listed.
+func WriteJSON(recipesDir string, w io.Writer) error {
+	if len(recipesDir) == 0 {
+		return fmt.Errorf("An image directory must be provided")
+	}
+
+	recipeNames, err := utils.GetChildDirectories(recipesDir)
+	if err != nil {
+		return err
+	}
+
+	recipes := make(map[string]Recipe, len(recipeNames))
+	listings := make(map[string]*recipeListing, len(recipeNames))
+	for _, recipeName := range recipeNames {
+		recipe, err := parseRecipe(recipesDir, recipeName)
+		mixins := recipe.Mixins
+		if mixins == nil {
+			mixins = []string{}
+		}
+		listing := &recipeListing{
+			Name:             recipe.Name,
+			RecipeDir:        recipe.RecipeDir,
+			Inherits:         recipe.Inherits,
+			InheritsExternal: recipe.InheritsExternal,
+			Mixins:           mixins,
+		}
+		if err != nil {
+			listing.ConfigError = err.Error()
+		}
+		recipes[recipeName] = recipe
+		listings[recipeName] = listing
+	}
+
+	computed := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var depth func(recipeName string) int
+	depth = func(recipeName string) int {
+		listing := listings[recipeName]
+		if computed[recipeName] {
+			return listing.Depth
+		}
+		if visiting[recipeName] {
+			listing.Cyclical = true
+			return 0
+		}
+		if len(listing.ConfigError) > 0 {
+			// Nothing is known about what it depends on.
+			computed[recipeName] = true
+			return 0
+		}
+		visiting[recipeName] = true
+		defer delete(visiting, recipeName)
+
+		recipe := recipes[recipeName]
+		for _, mixin := range recipe.Mixins {
+			if _, ok := recipes[mixin]; !ok {
+				listing.MissingParent = true
+			}
+		}
+
+		result := 0
+		if !recipe.InheritsExternal {
+			if _, ok := recipes[recipe.Inherits]; ok {
+				result = depth(recipe.Inherits) + 1
+				if listings[recipe.Inherits].Cyclical {
+					listing.Cyclical = true
+				}
+			} else {
+				listing.MissingParent = true
+			}
+		}
+
+		listing.Depth = result
+		computed[recipeName] = true
+		return result
+	}
+
+	sort.Strings(recipeNames)
+
+	ordered := make([]*recipeListing, 0, len(listings))
+	for _, recipeName := range recipeNames {
+		depth(recipeName)
+		ordered = append(ordered, listings[recipeName])
+	}
+	// What depth a cycle gets depends on where it was entered, so it isn't meaningful.
+	for _, listing := range ordered {
+		if listing.Cyclical {
+			listing.Depth = CyclicalDepth
+		}
+	}
+
+	// Parents are always shallower than their children, so this is a valid build order.
+	// Cyclical recipes can't be built in any order, they are listed last.
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Cyclical != ordered[j].Cyclical {
+			return !ordered[i].Cyclical
+		}
+		if ordered[i].Depth != ordered[j].Depth {
+			return ordered[i].Depth < ordered[j].Depth
+		}
+		return ordered[i].Name < ordered[j].Name
+	})
+	for i, listing := range ordered {
+		listing.Order = i
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ordered)
+}
@@ -5,13 +5,33 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
 
+	"github.com/godarch/darch/pkg/reference"
 	"github.com/godarch/darch/pkg/utils"
 )
 
+// ConfigurationError Every problem found with the configuration of a recipe.
+type ConfigurationError struct {
+	RecipeName string
+	Path       string
+	Problems   []string
+}
+
+func (e ConfigurationError) Error() string {
+	return fmt.Sprintf("invalid configuration for recipe %s (%s):\n  %s", e.RecipeName, e.Path, strings.Join(e.Problems, "\n  "))
+}
+
 type recipeConfiguration struct {
-	Inherits string `json:"inherits"`
+	Inherits   string            `json:"inherits"`
+	Mixins     []string          `json:"mixins"`
+	Tags       []string          `json:"tags"`
+	Env        map[string]string `json:"env"`
+	Arch       string            `json:"arch"`
+	Script     string            `json:"script"`
+	ScriptArgs []string          `json:"scriptArgs"`
 }
 
 func parseRecipe(recipesDir string, recipeName string) (Recipe, error) {
@@ -47,6 +67,20 @@ func parseRecipe(recipesDir string, recipeName string) (Recipe, error) {
 		recipe.Inherits = recipeConfiguration.Inherits
 	}
 
+	recipe.Mixins = recipeConfiguration.Mixins
+	recipe.Tags = recipeConfiguration.Tags
+	recipe.Env = recipeConfiguration.Env
+	recipe.Arch = recipeConfiguration.Arch
+	if len(recipe.Arch) == 0 {
+		recipe.Arch = DefaultArch
+	}
+
+	recipe.Script = recipeConfiguration.Script
+	if len(recipe.Script) == 0 {
+		recipe.Script = DefaultScript
+	}
+	recipe.ScriptArgs = recipeConfiguration.ScriptArgs
+
 	return recipe, nil
 }
 
@@ -64,15 +98,98 @@ func loadRecipeConfiguration(recipe Recipe) (recipeConfiguration, error) {
 		return recipeConfiguration, err
 	}
 
-	err = json.Unmarshal(jsonData, &recipeConfiguration)
+	problems := decodeRecipeConfiguration(jsonData, &recipeConfiguration)
+	problems = append(problems, validateRecipeConfiguration(recipeConfiguration)...)
+	if len(problems) > 0 {
+		return recipeConfiguration, ConfigurationError{
+			RecipeName: recipe.Name,
+			Path:       recipeConfigurationPath,
+			Problems:   problems,
+		}
+	}
 
-	if err != nil {
-		return recipeConfiguration, err
+	return recipeConfiguration, nil
+}
+
+// decodeRecipeConfiguration Decodes the configuration one key at a time,
+// so that every unknown key (or key with the wrong type) is reported, not just the first.
+func decodeRecipeConfiguration(jsonData []byte, config *recipeConfiguration) []string {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return []string{err.Error()}
 	}
 
-	if len(recipeConfiguration.Inherits) == 0 {
-		return recipeConfiguration, fmt.Errorf("No inherit property given for image %s", recipe.Name)
+	fields := make(map[string]reflect.Value)
+	configValue := reflect.ValueOf(config).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		fields[configValue.Type().Field(i).Tag.Get("json")] = configValue.Field(i)
 	}
 
-	return recipeConfiguration, nil
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := []string{}
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		if err := json.Unmarshal(raw[key], field.Addr().Interface()); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid value for %q: %v", key, err))
+		}
+	}
+
+	return problems
+}
+
+// validateRecipeConfiguration Returns every problem with the values of the configuration.
+func validateRecipeConfiguration(config recipeConfiguration) []string {
+	problems := []string{}
+
+	if len(config.Inherits) == 0 {
+		problems = append(problems, "no inherits property given")
+	} else if strings.HasPrefix(strings.ToLower(config.Inherits), "external:") {
+		// Local recipes can start with "external" (external-tools), only the prefix is checked.
+		if !strings.HasPrefix(config.Inherits, "external:") {
+			problems = append(problems, fmt.Sprintf("malformed external prefix in inherits %q, it should be \"external:<image>\"", config.Inherits))
+		} else if _, err := reference.ParseImage(config.Inherits[len("external:"):]); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid external image in inherits %q: %v", config.Inherits, err))
+		}
+	}
+
+	for _, mixin := range config.Mixins {
+		if len(mixin) == 0 {
+			problems = append(problems, "empty mixin name given")
+		}
+	}
+
+	for _, tag := range config.Tags {
+		if err := reference.ValidateTag(tag); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	envKeys := make([]string, 0, len(config.Env))
+	for key := range config.Env {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+	for _, key := range envKeys {
+		if len(key) == 0 || strings.ContainsAny(key, "= ") {
+			problems = append(problems, fmt.Sprintf("invalid environment variable name %q", key))
+		}
+	}
+
+	if len(config.Script) > 0 {
+		script := path.Clean(config.Script)
+		if path.IsAbs(script) || script == ".." || strings.HasPrefix(script, "../") {
+			problems = append(problems, fmt.Sprintf("script %q must be inside of the recipe directory", config.Script))
+		}
+	}
+
+	return problems
 }
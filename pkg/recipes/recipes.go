@@ -1,11 +1,25 @@
 package recipes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/godarch/darch/pkg/utils"
 )
 
+// DefaultArch The architecture recipes are built for, if they don't specify one.
+const DefaultArch = "x86_64"
+
+// DefaultScript The script (in the recipe's directory) that builds the recipe, if it doesn't specify one.
+const DefaultScript = "script"
+
 // Recipe A struct representing a recipe to be built.
 type Recipe struct {
 	Name             string
@@ -13,31 +27,69 @@ type Recipe struct {
 	RecipesDir       string
 	Inherits         string
 	InheritsExternal bool
+	// Mixins Other recipes whose scripts are ran (in order) on
+	// top of the inherited image, before this recipe's script.
+	// Only the mixin's script is used, not what the mixin inherits.
+	Mixins []string
+	// Tags Tags the recipe should always be built with.
+	Tags []string
+	// Env Environment variables given to the recipe's script.
+	Env map[string]string
+	// Arch The architecture (x86_64, aarch64, etc) of the image
+	// the recipe builds on, and therefore the image it produces.
+	Arch string
+	// Script The script (relative to the recipe's directory) that is ran to build
+	// the recipe, and the arguments it is given.
+	Script     string
+	ScriptArgs []string
 }
 
-func verifyDependencies(recipe Recipe, recipes map[string]Recipe, currentStack map[string]bool) error {
-	if currentStack == nil {
-		currentStack = make(map[string]bool, 0)
+func verifyDependencies(recipe Recipe, recipes map[string]Recipe, currentStack []string) error {
+	// The stack only holds the current path, so recipes reachable through
+	// more than one path (diamonds) are fine, only a recipe that depends
+	// on itself is a cycle. Each call gets its own copy of the path.
+	currentStack = append(currentStack[:len(currentStack):len(currentStack)], recipe.Name)
+
+	verify := func(dependency string) (bool, error) {
+		for _, name := range currentStack {
+			if name == dependency {
+				// Cyclical dependency detected!
+				return false, fmt.Errorf("Recipe %s has a cyclical dependency: %s", recipe.Name, formatChain(currentStack, dependency, "cycle"))
+			}
+		}
+		dependencyRecipe, ok := recipes[dependency]
+		if !ok {
+			return false, nil
+		}
+		return true, verifyDependencies(dependencyRecipe, recipes, currentStack)
 	}
 
-	if recipe.InheritsExternal {
-		// we reached the end, all good!
-		return nil
+	if !recipe.InheritsExternal {
+		exists, err := verify(recipe.Inherits)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("Recipe defintion %s inherits from %s, which doesn't exist: %s", recipe.Name, recipe.Inherits, formatChain(currentStack, recipe.Inherits, "missing"))
+		}
 	}
 
-	if _, ok := currentStack[recipe.Inherits]; ok {
-		// Cyclical dependency detected!
-		return fmt.Errorf("Recipe %s has a cyclical dependency", recipe.Name)
+	for _, mixinName := range recipe.Mixins {
+		exists, err := verify(mixinName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("Recipe defintion %s uses mixin %s, which doesn't exist: %s", recipe.Name, mixinName, formatChain(currentStack, mixinName, "missing"))
+		}
 	}
 
-	// Make this image as having been traversed.
-	currentStack[recipe.Name] = true
-
-	if parent, ok := recipes[recipe.Inherits]; ok {
-		return verifyDependencies(parent, recipes, currentStack)
-	}
+	return nil
+}
 
-	return fmt.Errorf("Recipe defintion %s inherits from %s, which doesn't exist", recipe.Name, recipe.Inherits)
+// formatChain Formats the path that lead to a problem, for example "a -> b -> a (cycle)".
+func formatChain(stack []string, last string, problem string) string {
+	return fmt.Sprintf("%s -> %s (%s)", strings.Join(stack, " -> "), last, problem)
 }
 
 // GetAllRecipes Return all the recipes in a recipe directory
@@ -46,8 +98,32 @@ func GetAllRecipes(recipesDir string) (map[string]Recipe, error) {
 		return nil, fmt.Errorf("An image directory must be provided")
 	}
 
-	recipeNames, err := utils.GetChildDirectories(recipesDir)
+	recipes, err := loadRecipes(recipesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	recipeNames := make([]string, 0, len(recipes))
+	for recipeName := range recipes {
+		recipeNames = append(recipeNames, recipeName)
+	}
+
+	// verify dependencies are satisfied and no circular dependencies
+	// (in order, so that the same problem is always reported the same way)
+	sort.Strings(recipeNames)
+	for _, recipeName := range recipeNames {
+		err := verifyDependencies(recipes[recipeName], recipes, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return recipes, nil
+}
 
+// loadRecipes Parses all the recipes in a recipe directory, without verifying their dependencies.
+func loadRecipes(recipesDir string) (map[string]Recipe, error) {
+	recipeNames, err := utils.GetChildDirectories(recipesDir)
 	if err != nil {
 		return nil, err
 	}
@@ -62,15 +138,51 @@ func GetAllRecipes(recipesDir string) (map[string]Recipe, error) {
 		recipes[recipeName] = recipe
 	}
 
-	// verify dependencies are satisfied and no circular dependencies
-	for _, recipe := range recipes {
-		err := verifyDependencies(recipe, recipes, nil)
-		if err != nil {
-			return nil, err
+	return recipes, nil
+}
+
+// BuildOrder Return all the recipes in a recipe directory, sorted so
+// that every recipe appears after the recipe it inherits from.
+// Siblings are sorted alphabetically, so the order is always the same.
+func BuildOrder(recipesDir string) ([]Recipe, error) {
+	allRecipes, err := GetAllRecipes(recipesDir)
+	if err != nil {
+		return nil, err
+	}
+	return SortRecipes(allRecipes), nil
+}
+
+// SortRecipes Sorts the given recipes so that parents come before their children.
+// The recipes must have had their dependencies verified (see GetAllRecipes).
+func SortRecipes(recipes map[string]Recipe) []Recipe {
+	recipeNames := make([]string, 0, len(recipes))
+	for recipeName := range recipes {
+		recipeNames = append(recipeNames, recipeName)
+	}
+	sort.Strings(recipeNames)
+
+	result := make([]Recipe, 0, len(recipes))
+	added := make(map[string]bool, len(recipes))
+
+	var add func(recipe Recipe)
+	add = func(recipe Recipe) {
+		if added[recipe.Name] {
+			return
 		}
+		if !recipe.InheritsExternal {
+			if parent, ok := recipes[recipe.Inherits]; ok {
+				add(parent)
+			}
+		}
+		added[recipe.Name] = true
+		result = append(result, recipe)
 	}
 
-	return recipes, nil
+	for _, recipeName := range recipeNames {
+		add(recipes[recipeName])
+	}
+
+	return result
 }
 
 // GetRecipe Get a single recipe by name
@@ -87,3 +199,55 @@ func GetRecipe(recipesDir string, recipeName string) (Recipe, error) {
 
 	return current, nil
 }
+
+// HashRecipe Creates a hash of everything in the recipe's directory,
+// and the directories of its mixins. The hash changes if any file
+// (or file mode) in those directories changes, unless it is ignored.
+func HashRecipe(recipe Recipe) (string, error) {
+	hash := sha256.New()
+
+	dirs := []string{recipe.RecipeDir}
+	for _, mixin := range recipe.Mixins {
+		dirs = append(dirs, path.Join(recipe.RecipesDir, mixin))
+	}
+
+	for _, dir := range dirs {
+		fmt.Fprintf(hash, "dir %s\n", filepath.Base(dir))
+		if err := hashDirectory(dir, hash); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashDirectory(dir string, w io.Writer) error {
+	// What the build won't see, doesn't change what it builds.
+	return walkRecipeDir(dir, func(filePath string, relPath string, info os.FileInfo) error {
+		// Only what is in a directory counts, not its size,
+		// which depends on the filesystem and what it once held.
+		fmt.Fprintf(w, "%s %s\n", relPath, info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\n", target)
+		case info.Mode().IsRegular():
+			// The size tells where the content ends.
+			fmt.Fprintf(w, "%d\n", info.Size())
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = io.Copy(w, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
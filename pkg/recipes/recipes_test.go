@@ -0,0 +1,418 @@
+package recipes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+func createRecipes(t *testing.T, configs map[string]string) string {
+	recipesDir := path.Join(os.TempDir(), utils.NewID())
+	for recipeName, config := range configs {
+		recipeDir := path.Join(recipesDir, recipeName)
+		if err := os.MkdirAll(recipeDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(recipeDir, "config.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recipesDir
+}
+
+func TestBuildOrder(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"web":  `{"inherits": "base"}`,
+		"db":   `{"inherits": "base"}`,
+		"base": `{"inherits": "external:archlinux"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	ordered, err := BuildOrder(recipesDir)
+	if err != nil {
+		t.Fatalf("error getting build order %v", err)
+	}
+
+	expected := []string{"base", "db", "web"}
+	if len(ordered) != len(expected) {
+		t.Fatalf("invalid recipe count")
+	}
+	for i, recipe := range ordered {
+		if recipe.Name != expected[i] {
+			t.Fatalf("expected %s at position %d, got %s", expected[i], i, recipe.Name)
+		}
+	}
+}
+
+func TestBuildOrderCycle(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"a": `{"inherits": "b"}`,
+		"b": `{"inherits": "a"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	_, err := BuildOrder(recipesDir)
+	if err == nil {
+		t.Fatal("should have detected the cycle")
+	}
+}
+
+func TestMissingMixin(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base": `{"inherits": "external:archlinux"}`,
+		"web":  `{"inherits": "base", "mixins": ["gpu"]}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	_, err := GetAllRecipes(recipesDir)
+	if err == nil {
+		t.Fatal("should have detected the missing mixin")
+	}
+	if !strings.Contains(err.Error(), "web") || !strings.Contains(err.Error(), "gpu") {
+		t.Fatalf("error should name the recipe and the missing mixin, got: %v", err)
+	}
+}
+
+func TestMixinCycle(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base": `{"inherits": "external:archlinux", "mixins": ["gpu"]}`,
+		"gpu":  `{"inherits": "base"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	_, err := GetAllRecipes(recipesDir)
+	if err == nil {
+		t.Fatal("should have detected the cycle through the mixin")
+	}
+}
+
+func TestArch(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base": `{"inherits": "external:archlinux"}`,
+		"pi":   `{"inherits": "external:archlinuxarm", "arch": "aarch64"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	allRecipes, err := GetAllRecipes(recipesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allRecipes["base"].Arch != DefaultArch {
+		t.Fatalf("expected the default arch, got %s", allRecipes["base"].Arch)
+	}
+	if allRecipes["pi"].Arch != "aarch64" {
+		t.Fatalf("expected aarch64, got %s", allRecipes["pi"].Arch)
+	}
+}
+
+func TestDiamond(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"common": `{"inherits": "external:archlinux"}`,
+		"a":      `{"inherits": "common"}`,
+		"b":      `{"inherits": "common"}`,
+		"gpu":    `{"inherits": "a"}`,
+		"web":    `{"inherits": "b", "mixins": ["a", "gpu"]}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	ordered, err := BuildOrder(recipesDir)
+	if err != nil {
+		t.Fatalf("diamond shouldn't be a cycle: %v", err)
+	}
+	if len(ordered) != 5 || ordered[0].Name != "common" {
+		t.Fatal("common should be built first")
+	}
+}
+
+func TestDependencyChain(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"web":     `{"inherits": "runtime"}`,
+		"runtime": `{"inherits": "base"}`,
+		"base":    `{"inherits": "nope"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	_, err := GetRecipe(recipesDir, "web")
+	if err == nil {
+		t.Fatal("should have detected the missing recipe")
+	}
+	if !strings.Contains(err.Error(), "base -> nope (missing)") {
+		t.Fatalf("error should have the chain, got: %v", err)
+	}
+
+	recipesDir2 := createRecipes(t, map[string]string{
+		"a": `{"inherits": "b"}`,
+		"b": `{"inherits": "c"}`,
+		"c": `{"inherits": "a"}`,
+	})
+	defer os.RemoveAll(recipesDir2)
+
+	_, err = GetAllRecipes(recipesDir2)
+	if err == nil {
+		t.Fatal("should have detected the cycle")
+	}
+	if !strings.Contains(err.Error(), "a -> b -> c -> a (cycle)") {
+		t.Fatalf("error should have the chain, got: %v", err)
+	}
+}
+
+func TestStageRecipeIgnores(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base": `{"inherits": "external:archlinux"}`,
+		"web":  `{"inherits": "base", "mixins": ["base"]}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	files := map[string]string{
+		"web/.darchignore":        "*.key\nbuild/\n/assets/*.iso\n!keep.key\n",
+		"web/script":              "#!/bin/bash",
+		"web/secret.key":          "secret",
+		"web/keep.key":            "public",
+		"web/build/output":        "output",
+		"web/assets/big.iso":      "iso",
+		"web/assets/logo.png":     "logo",
+		"web/nested/other.key":    "secret",
+		"base/script":             "#!/bin/bash",
+		"elsewhere/config.json":   `{"inherits": "base"}`,
+		"elsewhere/not-for-build": "secret",
+	}
+	for fileName, content := range files {
+		filePath := path.Join(recipesDir, fileName)
+		if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recipe, err := GetRecipe(recipesDir, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destination := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(destination)
+	if err = StageRecipe(recipe, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileName, expected := range map[string]bool{
+		"web/script":            true,
+		"web/keep.key":          true,
+		"web/assets/logo.png":   true,
+		"web/secret.key":        false,
+		"web/nested/other.key":  false,
+		"web/build/output":      false,
+		"web/assets/big.iso":    false,
+		"base/script":           true,
+		"elsewhere/config.json": false,
+	} {
+		if utils.FileExists(path.Join(destination, fileName)) != expected {
+			t.Fatalf("expected %s to be staged: %v", fileName, expected)
+		}
+	}
+
+	info, err := os.Stat(path.Join(destination, "web/script"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Fatal("the script should still be executable")
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base":    `{"inherits": "external:archlinux"}`,
+		"runtime": `{"inherits": "base"}`,
+		"web":     `{"inherits": "runtime"}`,
+		"broken":  `{"inherits": "nope"}`,
+		"a":       `{"inherits": "b"}`,
+		"b":       `{"inherits": "a"}`,
+		"c":       `{"inherits": "a"}`,
+		"invalid": `{"inherits": "base", "mixin": ["runtime"]}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	var buffer bytes.Buffer
+	if err := WriteJSON(recipesDir, &buffer); err != nil {
+		t.Fatalf("a missing parent (or invalid configuration) shouldn't be an error: %v", err)
+	}
+
+	listings := []recipeListing{}
+	if err := json.Unmarshal(buffer.Bytes(), &listings); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name     string
+		depth    int
+		missing  bool
+		cyclical bool
+	}{
+		{"base", 0, false, false},
+		{"broken", 0, true, false},
+		{"invalid", 0, false, false},
+		{"runtime", 1, false, false},
+		{"web", 2, false, false},
+		{"a", CyclicalDepth, false, true},
+		{"b", CyclicalDepth, false, true},
+		{"c", CyclicalDepth, false, true},
+	}
+	if len(listings) != len(expected) {
+		t.Fatal("invalid recipe count")
+	}
+	for i, listing := range listings {
+		if listing.Name != expected[i].name || listing.Depth != expected[i].depth || listing.MissingParent != expected[i].missing || listing.Cyclical != expected[i].cyclical || listing.Order != i {
+			t.Fatalf("unexpected listing at position %d: %+v", i, listing)
+		}
+	}
+	if !listings[0].InheritsExternal || listings[0].Inherits != "archlinux" {
+		t.Fatal("base should inherit the external image")
+	}
+	for _, listing := range listings {
+		if (listing.Name == "invalid") != (len(listing.ConfigError) > 0) {
+			t.Fatalf("expected only the invalid recipe to have a configuration error, got %+v", listing)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base":    `{"inherits": "external:archlinux"}`,
+		"minimal": `{"inherits": "base", "script": "build-minimal", "scriptArgs": ["--no-docs"]}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	allRecipes, err := GetAllRecipes(recipesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allRecipes["base"].Script != DefaultScript {
+		t.Fatalf("expected the default script, got %s", allRecipes["base"].Script)
+	}
+	if allRecipes["minimal"].Script != "build-minimal" || len(allRecipes["minimal"].ScriptArgs) != 1 {
+		t.Fatal("expected the configured script and arguments")
+	}
+
+	outsideDir := createRecipes(t, map[string]string{
+		"base": `{"inherits": "external:archlinux", "script": "../other/script"}`,
+	})
+	defer os.RemoveAll(outsideDir)
+
+	if _, err = GetAllRecipes(outsideDir); err == nil {
+		t.Fatal("scripts outside of the recipe directory shouldn't be allowed")
+	}
+}
+
+func TestConfigurationProblems(t *testing.T) {
+	recipesDir := createRecipes(t, map[string]string{
+		"base": `{"inherit": "external:archlinux", "tags": ["ok", "-bad"], "mixins": 5}`,
+		"web":  `{"inherits": "External:archlinux"}`,
+		"api":  `{"inherits": "external:"}`,
+		"tool": `{"inherits": "external-tools"}`,
+	})
+	defer os.RemoveAll(recipesDir)
+
+	_, err := parseRecipe(recipesDir, "base")
+	configErr, ok := err.(ConfigurationError)
+	if !ok {
+		t.Fatalf("expected a configuration error, got %v", err)
+	}
+	expected := []string{`unknown key "inherit"`, `"mixins"`, "no inherits property given", `invalid tag "-bad"`}
+	if len(configErr.Problems) != len(expected) {
+		t.Fatalf("expected every problem to be reported, got %v", configErr.Problems)
+	}
+	for i, problem := range expected {
+		if !strings.Contains(configErr.Problems[i], problem) {
+			t.Fatalf("expected %q to mention %q", configErr.Problems[i], problem)
+		}
+	}
+
+	if _, err = parseRecipe(recipesDir, "web"); err == nil || !strings.Contains(err.Error(), "malformed external prefix") {
+		t.Fatalf("expected a malformed external prefix, got %v", err)
+	}
+	if _, err = parseRecipe(recipesDir, "api"); err == nil || !strings.Contains(err.Error(), "invalid external image") {
+		t.Fatalf("expected an empty external image to be rejected, got %v", err)
+	}
+	if _, err = parseRecipe(recipesDir, "tool"); err != nil {
+		t.Fatalf("local parents starting with external should be allowed, got %v", err)
+	}
+}
+
+func TestIgnoreMatchAnyDepth(t *testing.T) {
+	dir := path.Join(os.TempDir(), utils.NewID())
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, IgnoreFile), []byte("**/cache/tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	matcher, err := loadIgnoreMatcher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, expected := range map[string]bool{
+		"cache/tmp":           true,
+		"deep/cache/tmp":      true,
+		"deep/er/cache/tmp":   true,
+		"deep/cache":          false,
+		"deep/cache/tmp/file": false,
+		"deep/mycache/tmp":    false,
+	} {
+		if matcher.ignored(relPath, true) != expected {
+			t.Fatalf("expected %s to be ignored: %v", relPath, expected)
+		}
+	}
+}
+
+func TestHashIgnoresDirectorySizes(t *testing.T) {
+	var hashes []string
+	for _, removed := range []int{0, 300} {
+		recipesDir := createRecipes(t, map[string]string{
+			"base": `{"inherits": "external:archlinux"}`,
+		})
+		defer os.RemoveAll(recipesDir)
+
+		// Directories (on most filesystems) don't shrink when their files are removed.
+		dir := path.Join(recipesDir, "base", "files")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < removed; i++ {
+			filePath := path.Join(dir, fmt.Sprintf("a-file-with-a-long-name-%d", i))
+			if err := ioutil.WriteFile(filePath, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < removed; i++ {
+			if err := os.Remove(path.Join(dir, fmt.Sprintf("a-file-with-a-long-name-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		recipe, err := GetRecipe(recipesDir, "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := HashRecipe(recipe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Fatal("expected the same files to hash the same, whatever the size of their directories")
+	}
+}
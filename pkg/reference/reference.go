@@ -2,15 +2,24 @@ package reference
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
-	containerdref "github.com/containerd/containerd/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	tagRegexp      = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	registryRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?$`)
 )
 
 // ImageRef An image reference.
 type ImageRef struct {
+	// Name The name of the image, including the registry (if any).
 	Name string
 	Tag  string
+	// Digest The digest the image is pinned to, if any.
+	Digest digest.Digest
 }
 
 // ParseImage Parses a string for image:tag.
@@ -19,37 +28,92 @@ func ParseImage(val string) (ImageRef, error) {
 }
 
 // ParseImageWithDefaultTag Parse an image name. If not tag is given in the image name, use the optionalTag as the tag.
+// References can be fully qualified (registry.example.com:5000/team/base:tag) and can be pinned to
+// a digest (base@sha256:...), in which case the default tag isn't used.
 func ParseImageWithDefaultTag(val, optionalTag string) (ImageRef, error) {
 	if len(val) == 0 {
 		return ImageRef{}, fmt.Errorf("no image name provided")
 	}
+	if strings.ContainsAny(val, " \t\n") {
+		return ImageRef{}, fmt.Errorf("invalid format %q", val)
+	}
+
 	result := ImageRef{}
-	spec, err := containerdref.Parse(val)
-	if err != nil {
-		return result, err
+	remaining := val
+
+	if i := strings.Index(remaining, "@"); i != -1 {
+		d, err := digest.Parse(remaining[i+1:])
+		if err != nil {
+			return result, fmt.Errorf("invalid digest in %q: %v", val, err)
+		}
+		result.Digest = d
+		remaining = remaining[:i]
 	}
-	if len(spec.Object) != 0 {
-		result.Name = spec.Locator
-		result.Tag = spec.Object
+
+	// The tag is after the last colon, unless that colon is the port of the registry.
+	if i := strings.LastIndex(remaining, ":"); i != -1 && !strings.Contains(remaining[i+1:], "/") {
+		result.Tag = remaining[i+1:]
+		remaining = remaining[:i]
+		if err := ValidateTag(result.Tag); err != nil {
+			return result, fmt.Errorf("%v in %q", err, val)
+		}
 	}
-	split := strings.Split(val, ":")
-	if len(split) > 2 {
-		return result, fmt.Errorf("invalid format")
+
+	result.Name = remaining
+	if len(result.Name) == 0 {
+		return result, fmt.Errorf("invalid format %q", val)
+	}
+	for _, component := range strings.Split(result.Name, "/") {
+		if len(component) == 0 {
+			return result, fmt.Errorf("invalid format %q", val)
+		}
+	}
+	if registry := result.Registry(); len(registry) != 0 && !registryRegexp.MatchString(registry) {
+		return result, fmt.Errorf("invalid registry %q in %q", registry, val)
 	}
-	result.Name = split[0]
-	if len(split) == 2 {
-		result.Tag = split[1]
+	if len(result.Repository()) == 0 {
+		return result, fmt.Errorf("invalid format %q", val)
 	}
 
-	if len(result.Tag) == 0 {
+	if len(result.Tag) == 0 && len(result.Digest) == 0 {
 		result.Tag = optionalTag
 	}
-	if len(result.Name) == 0 {
-		return result, fmt.Errorf("invalid format")
-	}
+
 	return result, nil
 }
 
+// ValidateTag Makes sure the tag only has the characters registries allow.
+func ValidateTag(tag string) error {
+	if !tagRegexp.MatchString(tag) {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
+
+// Registry Returns the registry host (and port) of the image, or
+// an empty string if the name doesn't start with one.
+func (image ImageRef) Registry() string {
+	i := strings.Index(image.Name, "/")
+	if i == -1 {
+		return ""
+	}
+	host := image.Name[:i]
+	// The same rule docker uses to tell a registry apart from a path.
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return ""
+}
+
+// Repository Returns the name of the image, without the registry.
+func (image ImageRef) Repository() string {
+	registry := image.Registry()
+	if len(registry) == 0 {
+		return image.Name
+	}
+	return image.Name[len(registry)+1:]
+}
+
 // WithTag Changes the tag of a image reference.
 func (image ImageRef) WithTag(tag string) (ImageRef, error) {
 	if len(tag) == 0 {
@@ -59,7 +123,14 @@ func (image ImageRef) WithTag(tag string) (ImageRef, error) {
 	return image, nil
 }
 
-// FullName Returns image:tag for the image reference.
+// FullName Returns image:tag (or image:tag@digest, if pinned) for the image reference.
 func (image ImageRef) FullName() string {
-	return image.Name + ":" + image.Tag
+	result := image.Name
+	if len(image.Tag) != 0 {
+		result = result + ":" + image.Tag
+	}
+	if len(image.Digest) != 0 {
+		result = result + "@" + image.Digest.String()
+	}
+	return result
 }
@@ -0,0 +1,65 @@
+package reference
+
+import (
+	"testing"
+)
+
+func TestParseImage(t *testing.T) {
+	dgst := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	for _, test := range []struct {
+		val        string
+		registry   string
+		repository string
+		tag        string
+		digest     string
+		fullName   string
+	}{
+		{"base", "", "base", "latest", "", "base:latest"},
+		{"base:custom", "", "base", "custom", "", "base:custom"},
+		{"godarch/base:custom", "", "godarch/base", "custom", "", "godarch/base:custom"},
+		{"docker.io/library/archlinux:latest", "docker.io", "library/archlinux", "latest", "", "docker.io/library/archlinux:latest"},
+		{"registry.example.com:5000/team/base", "registry.example.com:5000", "team/base", "latest", "", "registry.example.com:5000/team/base:latest"},
+		{"registry.example.com:5000/team/base@" + dgst, "registry.example.com:5000", "team/base", "", dgst, "registry.example.com:5000/team/base@" + dgst},
+		{"localhost/base:v1@" + dgst, "localhost", "base", "v1", dgst, "localhost/base:v1@" + dgst},
+	} {
+		ref, err := ParseImage(test.val)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", test.val, err)
+		}
+		if ref.Registry() != test.registry {
+			t.Fatalf("expected registry %q for %s, got %q", test.registry, test.val, ref.Registry())
+		}
+		if ref.Repository() != test.repository {
+			t.Fatalf("expected repository %q for %s, got %q", test.repository, test.val, ref.Repository())
+		}
+		if ref.Tag != test.tag {
+			t.Fatalf("expected tag %q for %s, got %q", test.tag, test.val, ref.Tag)
+		}
+		if ref.Digest.String() != test.digest {
+			t.Fatalf("expected digest %q for %s, got %q", test.digest, test.val, ref.Digest)
+		}
+		if ref.FullName() != test.fullName {
+			t.Fatalf("expected %s for %s, got %s", test.fullName, test.val, ref.FullName())
+		}
+		reparsed, err := ParseImage(ref.FullName())
+		if err != nil || reparsed != ref {
+			t.Fatalf("%s didn't round trip", ref.FullName())
+		}
+	}
+}
+
+func TestParseImageInvalid(t *testing.T) {
+	for _, val := range []string{
+		"",
+		"base:",
+		"base@sha256:nope",
+		"/base",
+		"registry.example.com:5000/",
+		"base:bad/tag",
+		"base image",
+	} {
+		if _, err := ParseImage(val); err == nil {
+			t.Fatalf("should have failed to parse %q", val)
+		}
+	}
+}
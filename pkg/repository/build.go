@@ -2,17 +2,25 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"runtime"
-
-	"github.com/opencontainers/image-spec/identity"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
-
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/oci"
 	"github.com/godarch/darch/pkg/recipes"
 	"github.com/godarch/darch/pkg/reference"
 	"github.com/godarch/darch/pkg/repository/manifest"
@@ -20,149 +28,733 @@ import (
 	"github.com/godarch/darch/pkg/workspace"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 )
 
-// BuildRecipe Builds a recipe.
-func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe, tag string, imagePrefix string, env []string) (reference.ImageRef, error) {
+// BuildOptions Options used when building recipes.
+type BuildOptions struct {
+	// Tag The tag to build the recipes with, defaults to "latest".
+	Tag string
+	// AdditionalTags Other tags to give the built images, on top of
+	// the tags declared by the recipes themselves.
+	AdditionalTags []string
+	// ImagePrefix The value to prepend to all image names (inherited and built).
+	ImagePrefix string
+	// Env The environment variables (KEY=VALUE) given to the recipe script.
+	// These take precedence over the variables declared by the recipe.
+	Env []string
+	// PrepareCheck An optional command that is ran repeatedly, after preparing
+	// the image, until it succeeds. The recipe script isn't ran until then.
+	// Each attempt runs in a new container on the prepared snapshot, so nothing
+	// it (or the prepare step) starts is still running for the next attempt, or
+	// for the script. It checks the prepared filesystem, and what the build
+	// needs from outside of the container (the network, mirrors, etc), not services.
+	PrepareCheck string
+	// PrepareCheckTimeout How long to wait for the PrepareCheck to succeed.
+	// Defaults to DefaultPrepareCheckTimeout.
+	PrepareCheckTimeout time.Duration
+	// Force Build the recipe, even if nothing changed since it was last built.
+	Force bool
+	// StateFile Where BuildRecipes records the recipes that have completed.
+	// Optional, and safe to delete to start a batch from scratch.
+	StateFile string
+	// Resume Skip the recipes the StateFile says have completed, as long
+	// as their inputs haven't changed and their images are still there.
+	Resume bool
+	// TrustPolicy If given, recipes can only be built on external
+	// images that the policy trusts.
+	TrustPolicy *TrustPolicy
+	// PullExternal Pull the external image a recipe inherits from,
+	// if it doesn't exist locally.
+	PullExternal bool
+	// Registry How to connect to the registry when pulling external images.
+	Registry RegistryOptions
+	// Retries How many times to retry the steps that are safe to retry
+	// (pulling and committing images) when they fail. Defaults to 0.
+	Retries int
+	// PackageCache A directory on the host to use as the pacman package
+	// cache (/var/cache/pacman/pkg), so that packages are only downloaded once.
+	PackageCache string
+	// PackageCachePerRecipe Give each recipe its own directory in the
+	// PackageCache, so that recipes (and concurrent builds) don't share
+	// packages that may have been partially downloaded.
+	PackageCachePerRecipe bool
+	// Secrets Files given to the recipe scripts (and only the scripts),
+	// that don't end up in the built image.
+	Secrets []BuildSecret
+	// Progress Is told about each stage of the build (see BuildStage*),
+	// defaults to logging each stage.
+	Progress ProgressHandler
+	// Stdout Where the output of the build goes, defaults to os.Stdout.
+	Stdout io.Writer
+	// Stderr Where the errors of the build go, defaults to os.Stderr.
+	Stderr io.Writer
+}
 
-	ctx = namespaces.WithNamespace(ctx, "darch")
+// RecipeHashLabel The image label holding the hash of what the image was built from.
+const RecipeHashLabel = "darch.recipe.hash"
 
-	if len(tag) == 0 {
-		tag = "latest"
+var (
+	// DefaultPrepareCheckTimeout How long to wait for the prepare check, if no timeout was given.
+	DefaultPrepareCheckTimeout = 30 * time.Second
+	// prepareCheckInterval How long to wait between attempts of the prepare check.
+	prepareCheckInterval = time.Second
+)
+
+// BuildRecipe Builds a recipe, and tags it with the additional tags.
+func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe, opts BuildOptions) (reference.ImageRef, error) {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+
+	newImage, err := session.buildRecipe(ctx, recipe, opts)
+	if err != nil {
+		return newImage, err
 	}
 
-	newImage, err := reference.ParseImage(imagePrefix + recipe.Name + ":" + tag)
+	return newImage, session.tagRecipeImage(ctx, recipe, newImage, opts)
+}
+
+func (session *Session) buildRecipe(ctx context.Context, recipe recipes.Recipe, opts BuildOptions) (reference.ImageRef, error) {
+	env := mergeEnv(recipe.Env, opts.Env)
+	progress := progressOrDefault(opts.Progress)
+
+	newImage, inheritsRef, err := resolveRecipeImages(recipe, opts)
 	if err != nil {
-		return reference.ImageRef{}, err
+		return newImage, err
 	}
 
-	// Use the image prefix when inheriting local recipes.
-	// External references are expected to be fully qualified.
-	inherits := recipe.Inherits
-	if !recipe.InheritsExternal {
-		inherits = imagePrefix + inherits
+	if err = session.EnsureParentExists(ctx, recipe, opts); err != nil {
+		return newImage, err
 	}
 
-	// NOTE: We use ParseImageWithDefaultTag here.
-	// This allows recipes to use specific tags, but when
-	// they aren't, it uses the tag the we are building
-	// the recipe with.
-	// This allows use to "darch build -t custom-tag base base-common"
-	// and each built image will use the appropriate inherited image.
-	inheritsRef, err := reference.ParseImageWithDefaultTag(inherits, newImage.Tag)
+	img, err := session.client.GetImage(ctx, inheritsRef.FullName())
 	if err != nil {
 		return newImage, err
 	}
 
-	img, err := session.client.GetImage(ctx, inheritsRef.FullName())
+	if err = session.verifyArch(ctx, img, recipe.Arch); err != nil {
+		return newImage, errors.Wrapf(err, "can't build %s on %s", recipe.Name, inheritsRef.FullName())
+	}
+
+	if recipe.InheritsExternal && opts.TrustPolicy != nil {
+		if err = opts.TrustPolicy.Verify(inheritsRef, img); err != nil {
+			return newImage, err
+		}
+	}
+
+	hash, err := recipeBuildHash(recipe, img, opts)
 	if err != nil {
 		return newImage, err
 	}
 
+	if !opts.Force {
+		builtHash, err := session.getBuiltHash(ctx, newImage)
+		if err != nil {
+			return newImage, err
+		}
+		if builtHash == hash {
+			progress.OnStage(recipe.Name, BuildStageUpToDate)
+			return newImage, nil
+		}
+	}
+
+	err = session.runBuildSteps(ctx, recipe, img, env, opts, progress, func(ctx context.Context, snapshotKey string) error {
+		return withRetries(ctx, opts.Retries, fmt.Sprintf("committing %s", newImage.FullName()), func() error {
+			return session.createImageFromSnapshot(ctx, img, snapshotKey, newImage, map[string]string{
+				RecipeHashLabel: hash,
+			})
+		})
+	})
+	return newImage, err
+}
+
+// runBuildSteps Runs the containers that build the recipe (preparing the image,
+// running the scripts and tearing down) on a snapshot of img, and then commits
+// the snapshot. The snapshot and lease are cleaned up, even if ctx is cancelled.
+func (session *Session) runBuildSteps(ctx context.Context, recipe recipes.Recipe, img containerd.Image, env []string, opts BuildOptions, progress ProgressHandler, commit func(ctx context.Context, snapshotKey string) error) error {
+	progress.OnStage(recipe.Name, BuildStageMountSetup)
+
 	ws, err := workspace.NewWorkspace("/tmp")
 	if err != nil {
-		return newImage, err
+		return err
 	}
 	defer ws.Destroy()
 
 	mounts, err := createTempMounts(ws.Path)
+	if err != nil {
+		return err
+	}
+
+	// The build only gets to see the recipe (and its mixins),
+	// without what their .darchignore files ignore.
+	stagedRecipesDir := path.Join(ws.Path, "recipes")
+	if err = recipes.StageRecipe(recipe, stagedRecipesDir); err != nil {
+		return err
+	}
 
 	mounts = append(mounts, specs.Mount{
 		Destination: "/recipes",
 		Type:        "bind",
-		Source:      recipe.RecipesDir,
+		Source:      stagedRecipesDir,
 		Options:     []string{"rbind", "ro"},
 	})
 
 	// Prevent garbage collection while we work.
-	ctx, done, err := session.client.WithLease(ctx)
+	ctx, done, err := session.withLease(ctx)
 	if err != nil {
-		return newImage, err
+		return err
 	}
 	defer done()
 
+	progress.OnStage(recipe.Name, BuildStageContainerCreate)
+
 	// Let's create the snapshot that all of our containers will run off of
 	snapshotKey := utils.NewID()
-	err = session.createSnapshot(ctx, snapshotKey, img)
+	err = session.runtime.createSnapshot(ctx, snapshotKey, img)
 	if err != nil {
-		return newImage, err
+		return err
 	}
-	defer session.deleteSnapshot(ctx, snapshotKey)
-
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", "/darch-prepare"),
-			),
-		},
-	}); err != nil {
-		return newImage, err
+	defer session.runtime.deleteSnapshot(cleanupContext(ctx), snapshotKey)
+
+	step := buildStep{
+		img:         img,
+		snapshotKey: snapshotKey,
+		env:         env,
+		mounts:      mounts,
+		stdout:      opts.Stdout,
+		stderr:      opts.Stderr,
 	}
 
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", fmt.Sprintf("/darch-runrecipe %s", recipe.Name)),
-			),
-		},
-	}); err != nil {
-		return newImage, err
+	// The teardown removes the package cache, so it doesn't get the host's cache.
+	teardownStep := step
+	if len(opts.PackageCache) > 0 {
+		packageCache := utils.ExpandPath(opts.PackageCache)
+		if opts.PackageCachePerRecipe {
+			packageCache = path.Join(packageCache, recipe.Name)
+		}
+		if err = os.MkdirAll(packageCache, os.ModePerm); err != nil {
+			return err
+		}
+		step.mounts = append(append([]specs.Mount{}, mounts...), specs.Mount{
+			Destination: "/var/cache/pacman/pkg",
+			Type:        "bind",
+			Source:      packageCache,
+			Options:     []string{"rbind", "rw"},
+		})
 	}
 
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", "/darch-teardown"),
-			),
-		},
-	}); err != nil {
-		return newImage, err
+	if err = session.runBuildStep(ctx, step, "/darch-prepare"); err != nil {
+		return err
 	}
 
-	return newImage, session.createImageFromSnapshot(ctx, img, snapshotKey, newImage)
+	if len(opts.PrepareCheck) > 0 {
+		if err = session.waitForPrepareCheck(ctx, step, opts.PrepareCheck, opts.PrepareCheckTimeout); err != nil {
+			return errors.Wrapf(err, "recipe %s", recipe.Name)
+		}
+	}
+
+	progress.OnStage(recipe.Name, BuildStageScriptRun)
+
+	// Only the scripts get the secrets.
+	scriptStep := step
+	secretMounts, err := secretMounts(opts.Secrets)
+	if err != nil {
+		return err
+	}
+	secretMountPoints, err := session.secretMountPoints(ctx, snapshotKey, secretMounts)
+	if err != nil {
+		return err
+	}
+	scriptStep.mounts = append(append([]specs.Mount{}, step.mounts...), secretMounts...)
+
+	// Apply the mixins first, so that the recipe's own script has the final say.
+	for _, mixinName := range recipe.Mixins {
+		mixin, err := recipes.GetRecipe(recipe.RecipesDir, mixinName)
+		if err != nil {
+			return err
+		}
+		if err = session.runBuildStep(ctx, scriptStep, recipeScriptCommand(mixin)); err != nil {
+			return errors.Wrapf(err, "error running mixin %s", mixinName)
+		}
+	}
+
+	if err = session.runBuildStep(ctx, scriptStep, recipeScriptCommand(recipe)); err != nil {
+		return err
+	}
+
+	// What the secrets were mounted on shouldn't be committed, even if empty.
+	if err = session.removeSecretMountPoints(ctx, snapshotKey, secretMountPoints); err != nil {
+		return err
+	}
+
+	progress.OnStage(recipe.Name, BuildStageCleanup)
+
+	if err = session.runBuildStep(ctx, teardownStep, "/darch-teardown"); err != nil {
+		return err
+	}
+
+	progress.OnStage(recipe.Name, BuildStageCommit)
+
+	return commit(ctx, snapshotKey)
 }
 
-func (session *Session) createSnapshot(ctx context.Context, snapshotKey string, img containerd.Image) error {
-	diffIDs, err := img.RootFS(ctx)
+// EnsureParentExists Makes sure the image a recipe inherits from exists locally,
+// so that a build doesn't fail halfway through. If opts.PullExternal is set,
+// missing external images are pulled.
+func (session *Session) EnsureParentExists(ctx context.Context, recipe recipes.Recipe, opts BuildOptions) error {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+
+	_, inheritsRef, err := resolveRecipeImages(recipe, opts)
 	if err != nil {
 		return err
 	}
-	parent := identity.ChainID(diffIDs).String()
-	if _, err := session.client.SnapshotService(containerd.DefaultSnapshotter).Prepare(ctx, snapshotKey, parent); err != nil {
+
+	_, err = session.imagesStore.Get(ctx, inheritsRef.FullName())
+	if err == nil {
+		return nil
+	}
+	if errors.Cause(err) != errdefs.ErrNotFound {
 		return err
 	}
+
+	if !recipe.InheritsExternal {
+		return fmt.Errorf("recipe %s inherits from %s, which hasn't been built", recipe.Name, inheritsRef.FullName())
+	}
+	if !opts.PullExternal {
+		return fmt.Errorf("recipe %s inherits from external image %s, which hasn't been pulled", recipe.Name, inheritsRef.FullName())
+	}
+
+	log.Printf("pulling %s\n", inheritsRef.FullName())
+	err = withRetries(ctx, opts.Retries, fmt.Sprintf("pulling %s", inheritsRef.FullName()), func() error {
+		// The policy is checked before the image is pulled, not only once it has been.
+		return session.PullImage(ctx, inheritsRef, PullOptions{RegistryOptions: opts.Registry, TrustPolicy: opts.TrustPolicy})
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error pulling %s for recipe %s", inheritsRef.FullName(), recipe.Name)
+	}
+	return nil
+}
+
+// NeedsRebuild Returns true if the recipe (or what it inherits from)
+// has changed since its image was last built with the given options.
+func (session *Session) NeedsRebuild(ctx context.Context, recipe recipes.Recipe, opts BuildOptions) (bool, error) {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+
+	newImage, hash, err := session.getBuildHash(ctx, recipe, opts)
+	if err != nil {
+		return false, err
+	}
+
+	builtHash, err := session.getBuiltHash(ctx, newImage)
+	if err != nil {
+		return false, err
+	}
+
+	return builtHash != hash, nil
+}
+
+// getBuildHash Returns the image the recipe will be built as, and
+// the hash of what it would be built from right now.
+func (session *Session) getBuildHash(ctx context.Context, recipe recipes.Recipe, opts BuildOptions) (reference.ImageRef, string, error) {
+	newImage, inheritsRef, err := resolveRecipeImages(recipe, opts)
+	if err != nil {
+		return newImage, "", err
+	}
+
+	img, err := session.client.GetImage(ctx, inheritsRef.FullName())
+	if err != nil {
+		return newImage, "", err
+	}
+
+	hash, err := recipeBuildHash(recipe, img, opts)
+	if err != nil {
+		return newImage, "", err
+	}
+
+	return newImage, hash, nil
+}
+
+// tagRecipeImage Gives the built image the tags declared by the recipe,
+// and the additional tags in the options.
+func (session *Session) tagRecipeImage(ctx context.Context, recipe recipes.Recipe, image reference.ImageRef, opts BuildOptions) error {
+	tags := utils.RemoveDuplicates(append(append([]string{}, recipe.Tags...), opts.AdditionalTags...))
+	for _, tag := range tags {
+		if tag == image.Tag {
+			continue
+		}
+		newImageRef, err := image.WithTag(tag)
+		if err != nil {
+			return err
+		}
+		log.Printf("tagging %s as %s\n", image.FullName(), newImageRef.FullName())
+		if err = session.TagImage(ctx, image, newImageRef); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (session *Session) deleteSnapshot(ctx context.Context, snapshotKey string) error {
-	return session.client.SnapshotService(containerd.DefaultSnapshotter).Remove(ctx, snapshotKey)
+// mergeEnv Merges the environment declared by a recipe with the
+// given environment (KEY=VALUE). The given environment wins on conflicts.
+func mergeEnv(recipeEnv map[string]string, env []string) []string {
+	result := []string{}
+	overridden := make(map[string]bool, len(env))
+	for _, e := range env {
+		overridden[strings.SplitN(e, "=", 2)[0]] = true
+	}
+
+	keys := make([]string, 0, len(recipeEnv))
+	for key := range recipeEnv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !overridden[key] {
+			result = append(result, key+"="+recipeEnv[key])
+		}
+	}
+
+	return append(result, env...)
 }
 
-func (session *Session) createImageFromSnapshot(ctx context.Context, img containerd.Image, activeSnapshotKey string, newImage reference.ImageRef) error {
+// resolveRecipeImages Returns the image a recipe will be built as,
+// and the image it will be built from.
+func resolveRecipeImages(recipe recipes.Recipe, opts BuildOptions) (reference.ImageRef, reference.ImageRef, error) {
+	tag := opts.Tag
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+
+	newImage, err := reference.ParseImage(opts.ImagePrefix + recipe.Name + ":" + tag)
+	if err != nil {
+		return reference.ImageRef{}, reference.ImageRef{}, err
+	}
+
+	// Use the image prefix when inheriting local recipes.
+	// External references are expected to be fully qualified.
+	inherits := recipe.Inherits
+	if !recipe.InheritsExternal {
+		inherits = opts.ImagePrefix + inherits
+	}
+
+	// NOTE: We use ParseImageWithDefaultTag here.
+	// This allows recipes to use specific tags, but when
+	// they aren't, it uses the tag the we are building
+	// the recipe with.
+	// This allows use to "darch build -t custom-tag base base-common"
+	// and each built image will use the appropriate inherited image.
+	inheritsRef, err := reference.ParseImageWithDefaultTag(inherits, newImage.Tag)
+	if err != nil {
+		return newImage, reference.ImageRef{}, err
+	}
+
+	return newImage, inheritsRef, nil
+}
+
+// recipeBuildHash Hashes everything that goes in to building a recipe:
+// the recipe directory, the image it inherits from and the environment.
+func recipeBuildHash(recipe recipes.Recipe, parent containerd.Image, opts BuildOptions) (string, error) {
+	recipeHash, err := recipes.HashRecipe(recipe)
+	if err != nil {
+		return "", err
+	}
+
+	env := mergeEnv(recipe.Env, opts.Env)
+	sort.Strings(env)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "recipe %s\n", recipeHash)
+	fmt.Fprintf(hash, "parent %s\n", parent.Target().Digest)
+	for _, e := range env {
+		fmt.Fprintf(hash, "env %s\n", e)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// archAliases The names images use (GOARCH) for the architectures recipes use (uname -m).
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7h":  "arm",
+	"i686":    "386",
+}
+
+// verifyArch Makes sure an image was built for the given architecture.
+// Images that don't specify an architecture are assumed to match.
+func (session *Session) verifyArch(ctx context.Context, img containerd.Image, arch string) error {
+	if len(arch) == 0 {
+		arch = recipes.DefaultArch
+	}
+
+	configDesc, err := img.Config(ctx)
+	if err != nil {
+		return err
+	}
+	p, err := content.ReadBlob(ctx, session.content, configDesc.Digest)
+	if err != nil {
+		return err
+	}
+	var config ocispec.Image
+	if err = json.Unmarshal(p, &config); err != nil {
+		return err
+	}
+
+	if len(config.Architecture) == 0 || config.Architecture == arch {
+		return nil
+	}
+	if alias, ok := archAliases[arch]; ok && alias == config.Architecture {
+		return nil
+	}
+
+	return fmt.Errorf("the image is %s, not %s", config.Architecture, arch)
+}
+
+// getBuiltHash Get the recipe hash an image was built with.
+// Returns an empty string if the image doesn't exist.
+func (session *Session) getBuiltHash(ctx context.Context, imageRef reference.ImageRef) (string, error) {
+	image, err := session.imagesStore.Get(ctx, imageRef.FullName())
+	if err != nil {
+		if errors.Cause(err) == errdefs.ErrNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return image.Labels[RecipeHashLabel], nil
+}
+
+// recipeScriptCommand The command that runs the script of a recipe, with its arguments.
+func recipeScriptCommand(recipe recipes.Recipe) string {
+	script := recipe.Script
+	if len(script) == 0 {
+		script = recipes.DefaultScript
+	}
+	return utils.ShellQuote(append([]string{"/darch-runrecipe", recipe.Name, script}, recipe.ScriptArgs...)...)
+}
+
+// buildStep The things that are shared between every container ran during a build.
+type buildStep struct {
+	img         containerd.Image
+	snapshotKey string
+	env         []string
+	mounts      []specs.Mount
+	stdout      io.Writer
+	stderr      io.Writer
+}
+
+func (session *Session) runBuildStep(ctx context.Context, step buildStep, command string) error {
+	return session.runtime.runContainer(ctx, containerRun{
+		img:         step.img,
+		snapshotKey: step.snapshotKey,
+		env:         step.env,
+		mounts:      step.mounts,
+		args:        []string{"/usr/bin/env", "bash", "-c", command},
+		stdout:      step.stdout,
+		stderr:      step.stderr,
+	})
+}
+
+// waitForPrepareCheck Runs the check (in a new container each time)
+// until it succeeds, or until the timeout expires.
+func (session *Session) waitForPrepareCheck(ctx context.Context, step buildStep, check string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultPrepareCheckTimeout
+	}
+
+	// The deadline also applies to the checks themselves, a check that hangs is killed.
+	checkCtx, cancel := context.WithDeadline(ctx, time.Now().Add(timeout))
+	defer cancel()
+
+	for {
+		err := session.runBuildStep(checkCtx, step, check)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-checkCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("prepare check %q didn't succeed within %s: %v", check, timeout, err)
+		case <-time.After(prepareCheckInterval):
+		}
+	}
+}
+
+// BuildRecipes Builds multiple recipes, running up to concurrency builds at once.
+// A recipe will only start building once the recipe it inherits from (if it is
+// also being built) has finished. When a build fails, no new builds are started,
+// the builds in-flight are allowed to finish, and the first error is returned.
+// If opts.StateFile is given, completed recipes are recorded so that a failed
+// batch can be resumed later (see opts.Resume).
+func (session *Session) BuildRecipes(ctx context.Context, rs []recipes.Recipe, opts BuildOptions, concurrency int) ([]reference.ImageRef, error) {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+
+	return session.buildRecipes(ctx, rs, opts, concurrency, func(ctx context.Context, recipe recipes.Recipe) (reference.ImageRef, error) {
+		return session.BuildRecipe(ctx, recipe, opts)
+	})
+}
+
+// buildRecipes Schedules the builds of BuildRecipes, building each recipe with build.
+func (session *Session) buildRecipes(ctx context.Context, rs []recipes.Recipe, opts BuildOptions, concurrency int, build func(ctx context.Context, recipe recipes.Recipe) (reference.ImageRef, error)) ([]reference.ImageRef, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var state *buildState
+	if len(opts.StateFile) > 0 {
+		var err error
+		state, err = loadBuildState(opts.StateFile, opts.Resume)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	batch := make(map[string]recipes.Recipe, len(rs))
+	for _, recipe := range rs {
+		if _, ok := batch[recipe.Name]; ok {
+			return nil, fmt.Errorf("recipe %s was given more than once", recipe.Name)
+		}
+		batch[recipe.Name] = recipe
+	}
+
+	// Sorting guarantees that a parent's channel exists before its children wait on it.
+	ordered := recipes.SortRecipes(batch)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		built    = make(map[string]reference.ImageRef, len(ordered))
+		finished = make(map[string]chan struct{}, len(ordered))
+		slots    = make(chan struct{}, concurrency)
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	for _, recipe := range ordered {
+		finished[recipe.Name] = make(chan struct{})
+	}
+
+	for _, recipe := range ordered {
+		wg.Add(1)
+		go func(recipe recipes.Recipe) {
+			defer wg.Done()
+			defer close(finished[recipe.Name])
+
+			// Each recipe only waits for its parent, so unrelated
+			// recipes (and siblings) can be built at the same time.
+			if !recipe.InheritsExternal {
+				if parentFinished, ok := finished[recipe.Inherits]; ok {
+					<-parentFinished
+				}
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if failed() {
+				return
+			}
+
+			if state != nil && opts.Resume {
+				mu.Lock()
+				previous, ok := state.Completed[recipe.Name]
+				mu.Unlock()
+				if ok {
+					image, skip, err := session.canResume(ctx, recipe, opts, previous)
+					if err == nil && skip {
+						log.Printf("%s already completed, skipping build\n", image.FullName())
+						if err = session.tagRecipeImage(ctx, recipe, image, opts); err != nil {
+							mu.Lock()
+							if firstErr == nil {
+								firstErr = errors.Wrapf(err, "error tagging %s", recipe.Name)
+							}
+							mu.Unlock()
+							return
+						}
+						mu.Lock()
+						built[recipe.Name] = image
+						mu.Unlock()
+						return
+					}
+				}
+			}
+
+			image, err := build(ctx, recipe)
+
+			var completed completedBuild
+			if err == nil && state != nil {
+				completed, err = session.getCompletedBuild(ctx, image)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && state != nil {
+				err = state.markCompleted(recipe.Name, completed)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "error building %s", recipe.Name)
+				}
+				return
+			}
+			built[recipe.Name] = image
+		}(recipe)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	result := make([]reference.ImageRef, 0, len(rs))
+	for _, recipe := range rs {
+		result = append(result, built[recipe.Name])
+	}
+
+	return result, nil
+}
+
+// canResume Returns true if the recipe completed in a previous batch,
+// and nothing has changed since.
+func (session *Session) canResume(ctx context.Context, recipe recipes.Recipe, opts BuildOptions, previous completedBuild) (reference.ImageRef, bool, error) {
+	newImage, hash, err := session.getBuildHash(ctx, recipe, opts)
+	if err != nil {
+		return newImage, false, err
+	}
+	if newImage.FullName() != previous.Image || hash != previous.Hash {
+		return newImage, false, nil
+	}
+	image, err := session.imagesStore.Get(ctx, newImage.FullName())
+	if err != nil {
+		if errors.Cause(err) == errdefs.ErrNotFound {
+			return newImage, false, nil
+		}
+		return newImage, false, err
+	}
+	return newImage, image.Target.Digest.String() == previous.Digest, nil
+}
+
+// getCompletedBuild Get what should be recorded in the build state for a built image.
+func (session *Session) getCompletedBuild(ctx context.Context, imageRef reference.ImageRef) (completedBuild, error) {
+	image, err := session.imagesStore.Get(ctx, imageRef.FullName())
+	if err != nil {
+		return completedBuild{}, err
+	}
+	return completedBuild{
+		Image:  imageRef.FullName(),
+		Digest: image.Target.Digest.String(),
+		Hash:   image.Labels[RecipeHashLabel],
+	}, nil
+}
+
+func (session *Session) createImageFromSnapshot(ctx context.Context, img containerd.Image, activeSnapshotKey string, newImage reference.ImageRef, labels map[string]string) error {
 	// First, let's get the parent image manifest so that we can
 	// later create a new one from it, with a new layer added to it.
 	m, err := manifest.LoadManifest(ctx, session.content, img.Target())
@@ -180,24 +772,29 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 		return err
 	}
 
-	lowerMounts, err := session.snapshotter.View(ctx, "temp-readonly-parent", snapshot.Parent)
+	// The view key must be unique, since other builds may be committing at the same time.
+	parentViewKey := utils.NewID()
+	lowerMounts, err := session.snapshotter.View(ctx, parentViewKey, snapshot.Parent)
 	if err != nil {
 		return err
 	}
-	defer session.snapshotter.Remove(ctx, "temp-readonly-parent")
+	defer session.snapshotter.Remove(cleanupContext(ctx), parentViewKey)
 
 	// Generate a diff in content store
 	diffs, err := session.client.DiffService().DiffMounts(ctx,
 		lowerMounts,
 		upperMounts,
 		diff.WithMediaType(ocispec.MediaTypeImageLayerGzip),
-		diff.WithReference("custom-ref"))
+		diff.WithReference("darch-diff-"+activeSnapshotKey))
 	if err != nil {
 		return err
 	}
 
 	// Add our new layer to the image manifest
 	err = m.AddLayer(ctx, session.content, diffs)
+	if err != nil {
+		return err
+	}
 
 	// Let's see if the image exists already, if so, let's delete it
 	_, err = session.client.GetImage(ctx, newImage.FullName())
@@ -207,7 +804,8 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 
 	_, err = session.client.ImageService().Create(ctx,
 		images.Image{
-			Name: newImage.FullName(),
+			Name:   newImage.FullName(),
+			Labels: labels,
 			Target: ocispec.Descriptor{
 				Digest:    m.Descriptor().Digest,
 				Size:      m.Descriptor().Size,
@@ -224,7 +822,7 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 	if err != nil {
 		return err
 	}
-	err = imageBuilt.Unpack(ctx, containerd.DefaultSnapshotter)
+	err = imageBuilt.Unpack(ctx, session.snapshotterName)
 	if err != nil {
 		return err
 	}
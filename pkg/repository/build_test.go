@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/leases"
+	"github.com/godarch/darch/pkg/recipes"
+	"github.com/godarch/darch/pkg/reference"
+	"github.com/godarch/darch/pkg/utils"
+)
+
+// fakeRuntime Records what a build does, instead of doing it with containerd.
+type fakeRuntime struct {
+	mu    sync.Mutex
+	calls []string
+	// run Decides how each container exits, they succeed if not given.
+	run func(ctx context.Context, run containerRun) error
+}
+
+func (r *fakeRuntime) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *fakeRuntime) createLease(ctx context.Context) (context.Context, func() error, error) {
+	r.record("create lease")
+	return leases.WithLease(ctx, "lease"), func() error {
+		r.record("delete lease")
+		return nil
+	}, nil
+}
+
+func (r *fakeRuntime) createSnapshot(ctx context.Context, snapshotKey string, img containerd.Image) error {
+	r.record("create snapshot")
+	return nil
+}
+
+func (r *fakeRuntime) deleteSnapshot(ctx context.Context, snapshotKey string) error {
+	if ctx.Err() != nil {
+		r.record("delete snapshot (cancelled)")
+		return ctx.Err()
+	}
+	r.record("delete snapshot")
+	return nil
+}
+
+func (r *fakeRuntime) runContainer(ctx context.Context, run containerRun) error {
+	r.record(strings.Join(run.args, " "))
+	if r.run != nil {
+		return r.run(ctx, run)
+	}
+	return nil
+}
+
+// createBuildRecipe Creates a recipes directory with the recipe "web",
+// which mixes in "ssh", and returns the recipe.
+func createBuildRecipe(t *testing.T) recipes.Recipe {
+	recipesDir := path.Join(os.TempDir(), utils.NewID())
+	for recipeName, config := range map[string]string{
+		"base": `{"inherits": "external:archlinux"}`,
+		"ssh":  `{"inherits": "base"}`,
+		"web":  `{"inherits": "base", "mixins": ["ssh"], "scriptArgs": ["--no-docs"]}`,
+	} {
+		if err := os.MkdirAll(path.Join(recipesDir, recipeName), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(recipesDir, recipeName, "config.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipe, err := recipes.GetRecipe(recipesDir, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recipe
+}
+
+var quietProgress = ProgressHandlerFunc(func(string, string) {})
+
+func TestBuildSteps(t *testing.T) {
+	recipe := createBuildRecipe(t)
+	defer os.RemoveAll(recipe.RecipesDir)
+
+	for _, check := range []string{"", "test -s /etc/pacman.d/mirrorlist"} {
+		runtime := &fakeRuntime{}
+		session := &Session{runtime: runtime}
+
+		err := session.runBuildSteps(context.Background(), recipe, nil, nil, BuildOptions{
+			PrepareCheck: check,
+		}, quietProgress, func(ctx context.Context, snapshotKey string) error {
+			runtime.record("commit")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			"create lease",
+			"create snapshot",
+			"/usr/bin/env bash -c /darch-prepare",
+		}
+		if len(check) > 0 {
+			expected = append(expected, "/usr/bin/env bash -c "+check)
+		}
+		expected = append(expected,
+			"/usr/bin/env bash -c '/darch-runrecipe' 'ssh' 'script'",
+			"/usr/bin/env bash -c '/darch-runrecipe' 'web' 'script' '--no-docs'",
+			"/usr/bin/env bash -c /darch-teardown",
+			"commit",
+			"delete snapshot",
+			"delete lease",
+		)
+		if !reflect.DeepEqual(runtime.calls, expected) {
+			t.Fatalf("expected the steps:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(runtime.calls, "\n"))
+		}
+	}
+}
+
+func TestPrepareCheckTimeoutBoundsHangingProbe(t *testing.T) {
+	runtime := &fakeRuntime{
+		run: func(ctx context.Context, run containerRun) error {
+			// The check never returns on its own.
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	session := &Session{runtime: runtime}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.waitForPrepareCheck(context.Background(), buildStep{}, "sleep infinity", 10*time.Millisecond)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "didn't succeed within") {
+			t.Fatalf("expected the prepare check timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the prepare check timeout didn't stop a hanging check")
+	}
+}
+
+func TestBuildRecipesRunsUnrelatedRecipesConcurrently(t *testing.T) {
+	rs := []recipes.Recipe{
+		{Name: "a", Inherits: "archlinux", InheritsExternal: true},
+		{Name: "a1", Inherits: "a"},
+		{Name: "a2", Inherits: "a"},
+		{Name: "b", Inherits: "archlinux", InheritsExternal: true},
+	}
+
+	var mu sync.Mutex
+	started := make(map[string]chan struct{})
+	finished := make(map[string]bool)
+	for _, recipe := range rs {
+		started[recipe.Name] = make(chan struct{})
+	}
+
+	session := &Session{}
+	_, err := session.buildRecipes(context.Background(), rs, BuildOptions{}, 2, func(ctx context.Context, recipe recipes.Recipe) (reference.ImageRef, error) {
+		close(started[recipe.Name])
+
+		mu.Lock()
+		parentFinished := recipe.InheritsExternal || finished[recipe.Inherits]
+		mu.Unlock()
+		if !parentFinished {
+			return reference.ImageRef{}, fmt.Errorf("%s started before %s finished", recipe.Name, recipe.Inherits)
+		}
+
+		// a1 only finishes once b is being built alongside it.
+		if recipe.Name == "a1" {
+			select {
+			case <-started["b"]:
+			case <-time.After(5 * time.Second):
+				return reference.ImageRef{}, fmt.Errorf("b didn't start while a1 was building")
+			}
+		}
+
+		mu.Lock()
+		finished[recipe.Name] = true
+		mu.Unlock()
+		return reference.ParseImage(recipe.Name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipe := range rs {
+		if !finished[recipe.Name] {
+			t.Fatalf("%s wasn't built", recipe.Name)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// buildState Tracks the recipes of a batch build that completed successfully,
+// so that a failed batch can be resumed without rebuilding them.
+// The file is safe to delete, doing so just starts the next batch from scratch.
+type buildState struct {
+	path      string
+	Completed map[string]completedBuild `json:"completed"`
+}
+
+type completedBuild struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	Hash   string `json:"hash"`
+}
+
+// loadBuildState Loads the state file. If we aren't resuming, or the
+// file doesn't exist, we start with an empty state.
+func loadBuildState(statePath string, resume bool) (*buildState, error) {
+	state := &buildState{
+		path:      statePath,
+		Completed: make(map[string]completedBuild),
+	}
+
+	if !resume {
+		return state, state.save()
+	}
+
+	jsonData, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, state.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(jsonData, state); err != nil {
+		return nil, err
+	}
+	if state.Completed == nil {
+		state.Completed = make(map[string]completedBuild)
+	}
+
+	return state, nil
+}
+
+func (state *buildState) markCompleted(recipeName string, build completedBuild) error {
+	state.Completed[recipeName] = build
+	return state.save()
+}
+
+func (state *buildState) save() error {
+	jsonData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(state.path, jsonData, 0600)
+}
@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// cleanupContext Returns a context to clean up with after an operation.
+// It keeps the namespace and lease of the given context, but it isn't
+// cancelled along with it, so that we can still clean up if the
+// operation was cancelled.
+func cleanupContext(ctx context.Context) context.Context {
+	result := context.Background()
+	if namespace, ok := namespaces.Namespace(ctx); ok {
+		result = namespaces.WithNamespace(result, namespace)
+	}
+	if lease, ok := leases.Lease(ctx); ok {
+		result = leases.WithLease(result, lease)
+	}
+	return result
+}
+
+// withLease Prevents garbage collection of what is created with the returned
+// context, until done is called. Unlike client.WithLease, done still releases
+// the lease if the context has been cancelled.
+func (session *Session) withLease(ctx context.Context) (context.Context, func() error, error) {
+	if _, ok := leases.Lease(ctx); ok {
+		return ctx, func() error {
+			return nil
+		}, nil
+	}
+
+	return session.runtime.createLease(ctx)
+}
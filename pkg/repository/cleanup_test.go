@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestCleanupContextSurvivesCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), "darch"))
+	ctx = leases.WithLease(ctx, "lease")
+	cancel()
+
+	cleanupCtx := cleanupContext(ctx)
+
+	if cleanupCtx.Err() != nil {
+		t.Fatal("cleanup context was cancelled with its parent")
+	}
+	if namespace, ok := namespaces.Namespace(cleanupCtx); !ok || namespace != "darch" {
+		t.Fatal("cleanup context lost the namespace")
+	}
+	if lease, ok := leases.Lease(cleanupCtx); !ok || lease != "lease" {
+		t.Fatal("cleanup context lost the lease")
+	}
+}
+
+func TestBuildCleansUpWhenCancelled(t *testing.T) {
+	recipe := createBuildRecipe(t)
+	defer os.RemoveAll(recipe.RecipesDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runtime := &fakeRuntime{
+		run: func(ctx context.Context, run containerRun) error {
+			if !strings.Contains(strings.Join(run.args, " "), "/darch-runrecipe") {
+				return nil
+			}
+			// Cancelled while the script is running.
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	session := &Session{runtime: runtime}
+
+	err := session.runBuildSteps(ctx, recipe, nil, nil, BuildOptions{}, quietProgress, func(ctx context.Context, snapshotKey string) error {
+		runtime.record("commit")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the build to be cancelled")
+	}
+
+	expected := []string{
+		"create lease",
+		"create snapshot",
+		"/usr/bin/env bash -c /darch-prepare",
+		"/usr/bin/env bash -c '/darch-runrecipe' 'ssh' 'script'",
+		"delete snapshot",
+		"delete lease",
+	}
+	if !reflect.DeepEqual(runtime.calls, expected) {
+		t.Fatalf("expected the snapshot and lease to be cleaned up:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(runtime.calls, "\n"))
+	}
+}
+
+// fakeContainer A container whose task runs until it is killed.
+type fakeContainer struct {
+	containerd.Container
+	calls  *[]string
+	status chan containerd.ExitStatus
+}
+
+func (c fakeContainer) record(call string, ctx context.Context) {
+	if ctx.Err() != nil {
+		call += " (cancelled)"
+	}
+	*c.calls = append(*c.calls, call)
+}
+
+func (c fakeContainer) NewTask(ctx context.Context, ioCreate cio.Creator, opts ...containerd.NewTaskOpts) (containerd.Task, error) {
+	c.record("new task", ctx)
+	return fakeTask{container: c}, nil
+}
+
+func (c fakeContainer) Delete(ctx context.Context, opts ...containerd.DeleteOpts) error {
+	c.record("delete container", ctx)
+	return nil
+}
+
+type fakeTask struct {
+	containerd.Task
+	container fakeContainer
+}
+
+func (t fakeTask) Start(ctx context.Context) error {
+	t.container.record("start task", ctx)
+	return nil
+}
+
+func (t fakeTask) Wait(ctx context.Context) (<-chan containerd.ExitStatus, error) {
+	return t.container.status, nil
+}
+
+func (t fakeTask) Kill(ctx context.Context, signal syscall.Signal, opts ...containerd.KillOpts) error {
+	t.container.record("kill task", ctx)
+	t.container.status <- containerd.ExitStatus{}
+	return nil
+}
+
+func (t fakeTask) Delete(ctx context.Context, opts ...containerd.ProcessDeleteOpts) (*containerd.ExitStatus, error) {
+	t.container.record("delete task", ctx)
+	return &containerd.ExitStatus{}, nil
+}
+
+func TestRunContainerTaskCleansUpWhenCancelled(t *testing.T) {
+	calls := []string{}
+	container := fakeContainer{calls: &calls, status: make(chan containerd.ExitStatus, 1)}
+
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), "darch"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if err := runContainerTask(ctx, container, ContainerConfig{}); err != context.Canceled {
+		t.Fatalf("expected the task to be cancelled, got %v", err)
+	}
+
+	expected := []string{"new task", "start task", "kill task", "delete task", "delete container"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected the task and container to be cleaned up:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(calls, "\n"))
+	}
+}
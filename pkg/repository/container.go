@@ -2,7 +2,10 @@ package repository
 
 import (
 	"context"
+	"io"
+	"os"
 	"path"
+	"syscall"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
@@ -18,6 +21,9 @@ type ContainerConfig struct {
 	env     []string
 	newOpts []containerd.NewContainerOpts
 	delOpts []containerd.DeleteOpts
+	// The output of the container, defaults to os.Stdout/os.Stderr.
+	stdout io.Writer
+	stderr io.Writer
 }
 
 func createTempMounts(dir string) ([]specs.Mount, error) {
@@ -42,7 +48,7 @@ func createTempMounts(dir string) ([]specs.Mount, error) {
 
 // RunContainer Runs a container
 func (session *Session) RunContainer(ctx context.Context, config ContainerConfig) error {
-	ctx = namespaces.WithNamespace(ctx, "darch")
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
 	id := utils.NewID()
 	container, err := session.client.NewContainer(ctx,
 		id,
@@ -52,9 +58,25 @@ func (session *Session) RunContainer(ctx context.Context, config ContainerConfig
 		return err
 	}
 
-	defer container.Delete(ctx, config.delOpts...)
+	return runContainerTask(ctx, container, config)
+}
+
+// runContainerTask Runs the task of the container until it exits, and deletes
+// them both. If ctx is cancelled, the task is killed first.
+func runContainerTask(ctx context.Context, container containerd.Container, config ContainerConfig) error {
+	// Clean up with a context that isn't cancelled, so that
+	// the container and task are removed even if we are.
+	defer container.Delete(cleanupContext(ctx), config.delOpts...)
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if config.stdout != nil {
+		stdout = config.stdout
+	}
+	if config.stderr != nil {
+		stderr = config.stderr
+	}
 
-	t, err := container.NewTask(ctx, cio.NewCreator(cio.WithStdio))
+	t, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(os.Stdin, stdout, stderr)))
 	if err != nil {
 		return err
 	}
@@ -63,17 +85,28 @@ func (session *Session) RunContainer(ctx context.Context, config ContainerConfig
 	if err != nil {
 		return err
 	}
-	defer t.Delete(ctx)
+	defer t.Delete(cleanupContext(ctx))
 
 	var statusC <-chan containerd.ExitStatus
-	if statusC, err = t.Wait(ctx); err != nil {
+	if statusC, err = t.Wait(cleanupContext(ctx)); err != nil {
 		return err
 	}
 
 	sigc := commands.ForwardAllSignals(ctx, t)
 	defer commands.StopCatch(sigc)
 
-	status := <-statusC
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-ctx.Done():
+		// We were cancelled, kill the task so that it can be deleted.
+		if err = t.Kill(cleanupContext(ctx), syscall.SIGKILL); err != nil {
+			return err
+		}
+		<-statusC
+		return ctx.Err()
+	}
+
 	code, _, err := status.Result()
 	if err != nil {
 		return err
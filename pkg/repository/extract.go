@@ -1,38 +1,130 @@
 package repository
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
-	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/oci"
 	"github.com/godarch/darch/pkg/reference"
+	"github.com/godarch/darch/pkg/signing"
 	"github.com/godarch/darch/pkg/utils"
 	"github.com/godarch/darch/pkg/workspace"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// extractExcludesFile A file images can provide that lists
+// paths (one per line) that should be omitted from the rootfs.
+const extractExcludesFile = "/darch-extract-excludes"
+
+// The types of artifacts an extraction produces.
+const (
+	ArtifactRootFS    = "rootfs"
+	ArtifactKernel    = "kernel"
+	ArtifactInitRAMFS = "initramfs"
+	ArtifactUcode     = "ucode"
+	ArtifactOther     = "other"
+)
+
+// The formats the rootfs can be extracted as.
+const (
+	ExtractFormatSquashFS = "squashfs"
+	ExtractFormatTar      = "tar"
+	ExtractFormatTarGz    = "tar.gz"
+)
+
+// extractManifestFile The file (relative to the destination) describing the extracted artifacts.
+const extractManifestFile = "image.json"
+
+// extractChecksumsFile The file (relative to the destination) with the
+// checksums of every extracted file, in the format of sha256sum.
+const extractChecksumsFile = "SHA256SUMS"
+
+// ExtractOptions Options used when extracting images.
+type ExtractOptions struct {
+	// PathMapper Decides where each artifact is placed, relative to the destination.
+	// It is given the type of the artifact (see Artifact*) and the path it
+	// would be placed at by default. The image.json manifest is updated to
+	// match. Defaults to placing every artifact at its default path.
+	PathMapper func(artifactType, defaultRelPath string) string
+	// Kernels The kernels (and their initramfs) to extract from /boot.
+	// The first one is the default kernel of the image. Defaults to every
+	// kernel in /boot, with "linux" as the default if it is there.
+	Kernels []ExtractKernel
+	// Format The format of the extracted rootfs (see ExtractFormat*),
+	// defaults to squashfs.
+	Format string
+	// SquashFS How the rootfs is compressed, when extracted as squashfs.
+	SquashFS SquashFSOptions
+	// Stdout Where the output of the extraction goes, defaults to os.Stdout.
+	Stdout io.Writer
+	// Stderr Where the errors of the extraction go, defaults to os.Stderr.
+	Stderr io.Writer
+	// SigningKey The file with the (gpg) private key used to sign the extracted
+	// files, once they are all written. Each file gets a detached .sig next
+	// to it, including the SHA256SUMS. Files aren't signed if not given.
+	SigningKey string
+}
+
+// SquashFSOptions The compression settings given to mksquashfs.
+// Anything not given is left to mksquashfs to decide.
+type SquashFSOptions struct {
+	// Compression The compressor (gzip, lz4, xz, zstd, etc).
+	Compression string
+	// CompressionLevel The compression level, for the compressors that have one (gzip, zstd, etc).
+	CompressionLevel int
+	// BlockSize The block size, in bytes.
+	BlockSize int
+}
+
+// ExtractKernel The file names (in /boot) of a kernel and its initramfs.
+type ExtractKernel struct {
+	Kernel    string
+	InitRAMFS string
+}
+
+// extractManifest The image.json describing what the extracted files are for.
+type extractManifest struct {
+	Kernel    string                  `json:"kernel"`
+	InitRAMFS string                  `json:"initramfs"`
+	RootFS    string                  `json:"rootfs"`
+	Ucode     []string                `json:"ucode,omitempty"`
+	Kernels   []extractManifestKernel `json:"kernels,omitempty"`
+}
+
+type extractManifestKernel struct {
+	Flavor    string `json:"flavor"`
+	Version   string `json:"version"`
+	Kernel    string `json:"kernel"`
+	InitRAMFS string `json:"initramfs"`
+}
+
 // ExtractImage Extracts an image (with tag) to a specified directory
-func (session *Session) ExtractImage(ctx context.Context, imageRef reference.ImageRef, destination string) error {
-	ctx = namespaces.WithNamespace(ctx, "darch")
+func (session *Session) ExtractImage(ctx context.Context, imageRef reference.ImageRef, destination string, opts ExtractOptions) error {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
 
-	ctx, done, err := session.client.WithLease(ctx) // Prevent garbage collection while we work.
-	if err != nil {
+	if err := verifyExtractOptions(opts); err != nil {
 		return err
 	}
-	defer done()
 
-	img, err := session.client.GetImage(ctx, imageRef.FullName())
+	ctx, done, err := session.withLease(ctx) // Prevent garbage collection while we work.
 	if err != nil {
 		return err
 	}
+	defer done()
 
 	tempMountsWs, err := workspace.NewWorkspace("")
 	if err != nil {
@@ -41,28 +133,61 @@ func (session *Session) ExtractImage(ctx context.Context, imageRef reference.Ima
 	defer tempMountsWs.Destroy()
 
 	mounts, err := createTempMounts(tempMountsWs.Path)
+	if err != nil {
+		return err
+	}
+
+	return session.extractImage(ctx, imageRef, destination, mounts, opts)
+}
+
+// extractImage Extracts an image, using the given (temporary) mounts for the container.
+func (session *Session) extractImage(ctx context.Context, imageRef reference.ImageRef, destination string, mounts []specs.Mount, opts ExtractOptions) error {
+	format := opts.Format
+	if len(format) == 0 {
+		format = ExtractFormatSquashFS
+	}
+
+	img, err := session.client.GetImage(ctx, imageRef.FullName())
+	if err != nil {
+		return err
+	}
 
 	// Create the snapshot that our extraction will happen on.
 	snapshotKey := utils.NewID()
-	err = session.createSnapshot(ctx, snapshotKey, img)
+	err = session.runtime.createSnapshot(ctx, snapshotKey, img)
+	if err != nil {
+		return err
+	}
+	defer session.runtime.deleteSnapshot(cleanupContext(ctx), snapshotKey)
+
+	excludes, err := session.getExtractExcludes(ctx, snapshotKey)
 	if err != nil {
 		return err
 	}
-	defer session.deleteSnapshot(ctx, snapshotKey)
 
-	err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", "/darch-extract"),
-			),
+	if err = session.verifyExtractKernels(ctx, snapshotKey, opts.Kernels); err != nil {
+		return err
+	}
+
+	kernels := make([]string, 0, len(opts.Kernels))
+	for _, kernel := range opts.Kernels {
+		kernels = append(kernels, fmt.Sprintf("%s:%s", kernel.Kernel, kernel.InitRAMFS))
+	}
+
+	err = session.runtime.runContainer(ctx, containerRun{
+		img:         img,
+		snapshotKey: snapshotKey,
+		env: []string{
+			fmt.Sprintf("DARCH_EXTRACT_KERNELS=%s", strings.Join(kernels, " ")),
+			fmt.Sprintf("DARCH_EXTRACT_FORMAT=%s", format),
+			fmt.Sprintf("DARCH_EXTRACT_SQUASHFS_COMPRESSION=%s", opts.SquashFS.Compression),
+			fmt.Sprintf("DARCH_EXTRACT_SQUASHFS_COMPRESSION_LEVEL=%s", optionalInt(opts.SquashFS.CompressionLevel)),
+			fmt.Sprintf("DARCH_EXTRACT_SQUASHFS_BLOCK_SIZE=%s", optionalInt(opts.SquashFS.BlockSize)),
 		},
+		mounts: mounts,
+		args:   append([]string{"/usr/bin/env", "bash", "/darch-extract"}, excludes...),
+		stdout: opts.Stdout,
+		stderr: opts.Stderr,
 	})
 	if err != nil {
 		return err
@@ -74,20 +199,418 @@ func (session *Session) ExtractImage(ctx context.Context, imageRef reference.Ima
 	}
 
 	err = mount.WithTempMount(ctx, upperMounts, func(root string) error {
-		srcDir := path.Join(root, "extract")
-		return filepath.Walk(path.Join(root, "extract"), func(_path string, _f os.FileInfo, _err error) error {
-			if _err != nil {
-				return _err
+		return copyArtifacts(path.Join(root, "extract"), destination, opts.PathMapper)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(opts.SigningKey) > 0 {
+		return signArtifacts(destination, opts.SigningKey)
+	}
+
+	return nil
+}
+
+// verifyExtractFormat Makes sure the rootfs can be extracted in the format (see ExtractFormat*).
+func verifyExtractFormat(format string) error {
+	switch format {
+	case "", ExtractFormatSquashFS, ExtractFormatTar, ExtractFormatTarGz:
+		return nil
+	default:
+		return fmt.Errorf("unknown rootfs format %s", format)
+	}
+}
+
+// verifyExtractOptions Makes sure the options make sense together, before extracting anything.
+// Whether mksquashfs supports the compression settings is left to mksquashfs.
+func verifyExtractOptions(opts ExtractOptions) error {
+	if err := verifyExtractFormat(opts.Format); err != nil {
+		return err
+	}
+	squashFS := opts.SquashFS
+	if squashFS != (SquashFSOptions{}) && len(opts.Format) > 0 && opts.Format != ExtractFormatSquashFS {
+		return fmt.Errorf("squashfs options can't be used with the %s format", opts.Format)
+	}
+	if squashFS.CompressionLevel < 0 {
+		return fmt.Errorf("invalid compression level %d", squashFS.CompressionLevel)
+	}
+	if squashFS.CompressionLevel > 0 && len(squashFS.Compression) == 0 {
+		return fmt.Errorf("a compression level requires a compression to be given")
+	}
+	if squashFS.BlockSize < 0 {
+		return fmt.Errorf("invalid block size %d", squashFS.BlockSize)
+	}
+	return nil
+}
+
+// optionalInt Formats the value, or returns an empty string if it wasn't given.
+func optionalInt(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// signArtifacts Signs the extracted files in the directory with the private key in keyFile.
+func signArtifacts(dir string, keyFile string) error {
+	files, err := signedArtifacts(dir)
+	if err != nil {
+		return err
+	}
+	return signing.SignFiles(keyFile, files)
+}
+
+// VerifyArtifacts Verifies the extracted files in the directory were signed
+// by the key in publicKeyFile, before they are used. Every file in the
+// SHA256SUMS (and the SHA256SUMS itself) must have a valid signature.
+func VerifyArtifacts(dir string, publicKeyFile string) error {
+	files, err := signedArtifacts(dir)
+	if err != nil {
+		return err
+	}
+	return signing.VerifyFiles(publicKeyFile, files)
+}
+
+// signedArtifacts Returns the files of an extraction that are signed, the
+// files in its SHA256SUMS, and the SHA256SUMS itself.
+func signedArtifacts(dir string) ([]string, error) {
+	lines, err := utils.GetFileLines(path.Join(dir, extractChecksumsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path.Join(dir, extractChecksumsFile)}
+	for _, line := range lines {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		files = append(files, path.Join(dir, fields[1]))
+	}
+
+	return files, nil
+}
+
+// copyArtifacts Copies the extracted artifacts to the destination, placing
+// each one where the path mapper says, and writes an updated manifest.
+func copyArtifacts(srcDir string, destination string, pathMapper func(artifactType, defaultRelPath string) string) error {
+	if pathMapper == nil {
+		pathMapper = func(_, defaultRelPath string) string {
+			return defaultRelPath
+		}
+	}
+
+	manifestData, err := ioutil.ReadFile(path.Join(srcDir, extractManifestFile))
+	if err != nil {
+		return err
+	}
+	manifest := extractManifest{}
+	if err = json.Unmarshal(manifestData, &manifest); err != nil {
+		return err
+	}
+
+	artifactTypes := map[string]string{
+		manifest.RootFS:    ArtifactRootFS,
+		manifest.Kernel:    ArtifactKernel,
+		manifest.InitRAMFS: ArtifactInitRAMFS,
+	}
+	for _, ucode := range manifest.Ucode {
+		artifactTypes[ucode] = ArtifactUcode
+	}
+	for _, kernel := range manifest.Kernels {
+		artifactTypes[kernel.Kernel] = ArtifactKernel
+		artifactTypes[kernel.InitRAMFS] = ArtifactInitRAMFS
+	}
+
+	// The paths every artifact was copied to, keyed by their default path.
+	copied := make(map[string]string)
+	used := make(map[string]bool)
+	// The regular files that were copied, symlinks aren't checksummed.
+	checksummed := []string{extractManifestFile}
+
+	err = filepath.Walk(srcDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcDir, filePath)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			dirPath := path.Join(destination, relPath)
+			if relPath == "." {
+				// The destination belongs to the caller, it is used as it is.
+				return os.MkdirAll(dirPath, os.ModePerm)
+			}
+			// Recreate the directory as it was, unless it is already there, artifacts
+			// mapped somewhere else get their directories created as needed.
+			if existing, err := os.Lstat(dirPath); err == nil {
+				if !existing.IsDir() {
+					return fmt.Errorf("can't create directory %s, it already exists", dirPath)
+				}
+				return nil
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			if err = os.Mkdir(dirPath, os.ModePerm); err != nil {
+				return err
 			}
-			if !_f.IsDir() && strings.HasPrefix(_path, srcDir) {
-				return utils.CopyFile(_path, path.Join(destination, _path[len(srcDir):]))
+			if err = os.Chmod(dirPath, info.Mode().Perm()); err != nil {
+				return err
 			}
+			return preserveOwnership(dirPath, info)
+		}
+
+		if relPath == extractManifestFile {
+			// We write our own, once we know where everything went.
 			return nil
-		})
+		}
+
+		artifactType, ok := artifactTypes[relPath]
+		if !ok {
+			artifactType = ArtifactOther
+		}
+
+		destRelPath := filepath.Clean(pathMapper(artifactType, relPath))
+		if filepath.IsAbs(destRelPath) || destRelPath == "." || destRelPath == ".." || strings.HasPrefix(destRelPath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %s for artifact %s", destRelPath, relPath)
+		}
+		if used[destRelPath] || destRelPath == extractManifestFile || destRelPath == extractChecksumsFile {
+			return fmt.Errorf("artifact %s was mapped to %s, which is already used", relPath, destRelPath)
+		}
+		used[destRelPath] = true
+
+		destPath := path.Join(destination, destRelPath)
+		if err = os.MkdirAll(path.Dir(destPath), os.ModePerm); err != nil {
+			return err
+		}
+		// Extracting again replaces what was there, be it a file or a symlink
+		// (which would otherwise fail to be created, or be written through).
+		if existing, err := os.Lstat(destPath); err == nil {
+			if existing.IsDir() {
+				return fmt.Errorf("can't copy artifact %s to %s, it is a directory", relPath, destPath)
+			}
+			if err = os.Remove(destPath); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Recreate the symlink as is, instead of copying what it points to.
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(target, destPath); err != nil {
+				return err
+			}
+		} else {
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("artifact %s isn't a regular file", relPath)
+			}
+			// This preserves the mode of the file.
+			if err = utils.CopyFile(filePath, destPath); err != nil {
+				return err
+			}
+			checksummed = append(checksummed, destRelPath)
+		}
+
+		copied[relPath] = destRelPath
+		return preserveOwnership(destPath, info)
 	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	mapped := func(relPath string) string {
+		if destRelPath, ok := copied[relPath]; ok {
+			return destRelPath
+		}
+		return relPath
+	}
+	manifest.RootFS = mapped(manifest.RootFS)
+	manifest.Kernel = mapped(manifest.Kernel)
+	manifest.InitRAMFS = mapped(manifest.InitRAMFS)
+	for i := range manifest.Ucode {
+		manifest.Ucode[i] = mapped(manifest.Ucode[i])
+	}
+	for i := range manifest.Kernels {
+		manifest.Kernels[i].Kernel = mapped(manifest.Kernels[i].Kernel)
+		manifest.Kernels[i].InitRAMFS = mapped(manifest.Kernels[i].InitRAMFS)
+	}
+
+	manifestData, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path.Join(destination, extractManifestFile), manifestData, 0644); err != nil {
+		return err
+	}
+
+	return writeChecksums(destination, checksummed)
+}
+
+// preserveOwnership Gives the file the same owner as the file it was copied from.
+// Only root can do this, so when we aren't root, the owner is left as is.
+func preserveOwnership(filePath string, info os.FileInfo) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(filePath, int(stat.Uid), int(stat.Gid))
+}
+
+// writeChecksums Writes the sha256 of the given files (relative to the
+// directory), so that "sha256sum -c" can verify them from within it.
+func writeChecksums(dir string, relPaths []string) error {
+	sort.Strings(relPaths)
+
+	var checksums bytes.Buffer
+	for _, relPath := range relPaths {
+		f, err := os.Open(path.Join(dir, relPath))
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&checksums, "%s  %s\n", hex.EncodeToString(hash.Sum(nil)), filepath.ToSlash(relPath))
+	}
+
+	return ioutil.WriteFile(path.Join(dir, extractChecksumsFile), checksums.Bytes(), 0644)
+}
+
+// getExtractExcludes Reads the paths the image wants excluded from its rootfs.
+// If the image doesn't have an excludes file, nothing is excluded.
+func (session *Session) getExtractExcludes(ctx context.Context, snapshotKey string) ([]string, error) {
+	mounts, err := session.snapshotter.Mounts(ctx, snapshotKey)
+	if err != nil {
+		return nil, err
+	}
+
+	excludes := []string{}
+	err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		excludesFile, exists, err := imageFile(root, extractExcludesFile)
+		if err != nil || !exists {
+			return err
+		}
+		lines, err := utils.GetFileLines(excludesFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			excludes = append(excludes, line)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return excludes, nil
+}
+
+// verifyExtractKernels Makes sure the requested kernels (and their initramfs) are in /boot.
+// Kernels are often symlinks, they are resolved within the image, not on the host.
+func (session *Session) verifyExtractKernels(ctx context.Context, snapshotKey string, kernels []ExtractKernel) error {
+	if len(kernels) == 0 {
+		return nil
+	}
+
+	mounts, err := session.snapshotter.Mounts(ctx, snapshotKey)
+	if err != nil {
+		return err
+	}
+
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		for _, kernel := range kernels {
+			for _, fileName := range []string{kernel.Kernel, kernel.InitRAMFS} {
+				if len(fileName) == 0 || strings.ContainsAny(fileName, "/: ") {
+					return fmt.Errorf("invalid kernel file name %q", fileName)
+				}
+				_, exists, err := imageFile(root, path.Join("/boot", fileName))
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("/boot/%s doesn't exist in the image", fileName)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// maxImageSymlinks The number of symlinks imageFile follows before giving up, like the kernel.
+const maxImageSymlinks = 40
+
+// imageFile Returns where a file (given as an absolute path in the image) is in
+// the image mounted at root, and whether it exists. Symlinks are resolved
+// within root, the way they would be in the image, so that they can't lead
+// to the files of the host. Anything that isn't a regular file is an error.
+func imageFile(root string, filePath string) (string, bool, error) {
+	resolved := "/"
+	remaining := strings.Split(filePath, "/")
+	for followed := 0; len(remaining) > 0; {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			// Can't go above the root of the image.
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		current := path.Join(resolved, component)
+		info, err := os.Lstat(path.Join(root, current))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = current
+			continue
+		}
+
+		followed++
+		if followed > maxImageSymlinks {
+			return "", false, fmt.Errorf("too many levels of symlinks in %s", filePath)
+		}
+		target, err := os.Readlink(path.Join(root, current))
+		if err != nil {
+			return "", false, err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	info, err := os.Stat(path.Join(root, resolved))
+	if err != nil {
+		return "", false, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", false, fmt.Errorf("%s isn't a regular file in the image", filePath)
+	}
+	return path.Join(root, resolved), true, nil
 }
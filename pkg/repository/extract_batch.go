@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/godarch/darch/pkg/reference"
+	"github.com/godarch/darch/pkg/workspace"
+)
+
+// ExtractJob An image to extract, and where to extract it to.
+type ExtractJob struct {
+	ImageRef    reference.ImageRef
+	Destination string
+	Options     ExtractOptions
+}
+
+// ExtractImagesOptions Options used when extracting many images at once.
+type ExtractImagesOptions struct {
+	// Concurrency The number of images that can be extracted at the same time, defaults to 1.
+	Concurrency int
+	// FailFast Don't start any more jobs once one has failed. The
+	// jobs that have already started are allowed to finish.
+	FailFast bool
+}
+
+// ExtractJobError The error of a job that failed.
+type ExtractJobError struct {
+	Job ExtractJob
+	Err error
+}
+
+// ExtractImagesError Every job of an ExtractImages that failed, or wasn't started.
+type ExtractImagesError struct {
+	Total      int
+	Failed     []ExtractJobError
+	NotStarted []ExtractJob
+}
+
+func (e ExtractImagesError) Error() string {
+	lines := []string{fmt.Sprintf("%d of %d images couldn't be extracted", len(e.Failed)+len(e.NotStarted), e.Total)}
+	for _, failed := range e.Failed {
+		lines = append(lines, fmt.Sprintf("%s: %v", failed.Job.ImageRef.FullName(), failed.Err))
+	}
+	for _, job := range e.NotStarted {
+		lines = append(lines, fmt.Sprintf("%s: not started", job.ImageRef.FullName()))
+	}
+	return strings.Join(lines, "\n  ")
+}
+
+// ExtractImages Extracts each of the images to its destination, sharing the
+// lease and temporary mounts between them. Every job is attempted (unless
+// opts.FailFast is set, or ctx is cancelled), and the jobs that failed
+// (or weren't started) are returned as an ExtractImagesError.
+func (session *Session) ExtractImages(ctx context.Context, jobs []ExtractJob, opts ExtractImagesOptions) error {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+
+	if err := verifyExtractJobs(jobs); err != nil {
+		return err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, done, err := session.withLease(ctx) // Prevent garbage collection while we work.
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tempMountsWs, err := workspace.NewWorkspace("")
+	if err != nil {
+		return err
+	}
+	defer tempMountsWs.Destroy()
+
+	mounts, err := createTempMounts(tempMountsWs.Path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		anyError bool
+		errs     = make([]error, len(jobs))
+		result   = ExtractImagesError{Total: len(jobs)}
+		slots    = make(chan struct{}, concurrency)
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return anyError
+	}
+
+launch:
+	for i, job := range jobs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			// Cancelled while waiting for a slot, the jobs that are running stop on their own.
+			result.NotStarted = append(result.NotStarted, jobs[i:]...)
+			break launch
+		}
+
+		if ctx.Err() != nil || (opts.FailFast && failed()) {
+			<-slots
+			result.NotStarted = append(result.NotStarted, jobs[i:]...)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, job ExtractJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// Each extraction cleans up its own snapshot when it is done.
+			err := session.extractImage(ctx, job.ImageRef, job.Destination, mounts, job.Options)
+			if err != nil {
+				mu.Lock()
+				errs[i] = err
+				anyError = true
+				mu.Unlock()
+			}
+		}(i, job)
+	}
+
+	wg.Wait()
+
+	// Reported in the order the jobs were given, not the order they failed in.
+	for i, err := range errs {
+		if err != nil {
+			result.Failed = append(result.Failed, ExtractJobError{Job: jobs[i], Err: err})
+		}
+	}
+
+	if len(result.Failed) > 0 || len(result.NotStarted) > 0 {
+		return result
+	}
+	return nil
+}
+
+// verifyExtractJobs Makes sure the jobs can be ran together, before any of them are.
+// Jobs can't share a destination, or extract into the destination of another.
+func verifyExtractJobs(jobs []ExtractJob) error {
+	destinations := make([]string, 0, len(jobs))
+	for i, job := range jobs {
+		if len(job.Destination) == 0 {
+			return fmt.Errorf("no destination given for %s", job.ImageRef.FullName())
+		}
+		if err := verifyExtractOptions(job.Options); err != nil {
+			return err
+		}
+		destination, err := filepath.Abs(job.Destination)
+		if err != nil {
+			return err
+		}
+		for j, other := range destinations {
+			if isWithin(destination, other) || isWithin(other, destination) {
+				return fmt.Errorf("%s (extracted to %s) and %s (extracted to %s) can't be extracted together, their destinations overlap", jobs[j].ImageRef.FullName(), jobs[j].Destination, jobs[i].ImageRef.FullName(), job.Destination)
+			}
+		}
+		destinations = append(destinations, destination)
+	}
+	return nil
+}
+
+// isWithin Returns true if the (clean, absolute) path is dir, or is inside of it.
+func isWithin(filePath string, dir string) bool {
+	relPath, err := filepath.Rel(dir, filePath)
+	if err != nil {
+		return false
+	}
+	return relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,396 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/godarch/darch/pkg/reference"
+	"github.com/godarch/darch/pkg/utils"
+)
+
+func createExtracted(t *testing.T, files map[string]string) string {
+	dir := path.Join(os.TempDir(), utils.NewID())
+	for fileName, content := range files {
+		filePath := path.Join(dir, fileName)
+		if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCopyArtifactsChecksums(t *testing.T) {
+	src := createExtracted(t, map[string]string{
+		"image.json":          `{"kernel": "vmlinuz-linux", "initramfs": "initramfs-linux.img", "rootfs": "rootfs.squash"}`,
+		"vmlinuz-linux":       "kernel",
+		"initramfs-linux.img": "initramfs",
+		"rootfs.squash":       "rootfs",
+	})
+	defer os.RemoveAll(src)
+	destination := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(destination)
+
+	err := copyArtifacts(src, destination, func(artifactType, defaultRelPath string) string {
+		if artifactType == ArtifactKernel {
+			return path.Join("boot", defaultRelPath)
+		}
+		return defaultRelPath
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ioutil.ReadFile(path.Join(destination, "image.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ""
+	for _, file := range []struct{ name, content string }{
+		{"boot/vmlinuz-linux", "kernel"},
+		{"image.json", string(manifest)},
+		{"initramfs-linux.img", "initramfs"},
+		{"rootfs.squash", "rootfs"},
+	} {
+		sum := sha256.Sum256([]byte(file.content))
+		expected += fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), file.name)
+	}
+
+	checksums, err := ioutil.ReadFile(path.Join(destination, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(checksums) != expected {
+		t.Fatalf("expected checksums:\n%s\ngot:\n%s", expected, checksums)
+	}
+}
+
+func TestCopyArtifactsPreservesSymlinksAndModes(t *testing.T) {
+	src := createExtracted(t, map[string]string{
+		"image.json":            `{"kernel": "vmlinuz", "initramfs": "initramfs-linux.img", "rootfs": "rootfs.squash"}`,
+		"vmlinuz-linux":         "kernel",
+		"initramfs-linux.img":   "initramfs",
+		"rootfs.squash":         "rootfs",
+		"firmware/firmware.bin": "firmware",
+	})
+	defer os.RemoveAll(src)
+	if err := os.Symlink("vmlinuz-linux", path.Join(src, "vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(src, "rootfs.squash"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(src, "firmware"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	destination := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(destination)
+
+	if err := copyArtifacts(src, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(path.Join(destination, "vmlinuz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("the symlink was dereferenced")
+	}
+	target, err := os.Readlink(path.Join(destination, "vmlinuz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "vmlinuz-linux" {
+		t.Fatalf("expected the symlink to point to vmlinuz-linux, got %s", target)
+	}
+
+	info, err = os.Stat(path.Join(destination, "rootfs.squash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600 for the rootfs, got %v", info.Mode().Perm())
+	}
+
+	info, err = os.Stat(path.Join(destination, "firmware"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("expected mode 0700 for the directory, got %v", info.Mode().Perm())
+	}
+
+	// Extracting again, over what was extracted, replaces it.
+	if err = os.Remove(path.Join(src, "vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("rootfs.squash", path.Join(src, "vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyArtifacts(src, destination, nil); err != nil {
+		t.Fatalf("extracting again should replace the symlink: %v", err)
+	}
+	if target, err = os.Readlink(path.Join(destination, "vmlinuz")); err != nil || target != "rootfs.squash" {
+		t.Fatalf("expected the symlink to be replaced, got %s (%v)", target, err)
+	}
+}
+
+func TestCopyArtifactsKeepsDestination(t *testing.T) {
+	src := createExtracted(t, map[string]string{
+		"image.json":    `{"kernel": "vmlinuz-linux", "initramfs": "initramfs-linux.img", "rootfs": "rootfs.squash"}`,
+		"rootfs.squash": "rootfs",
+	})
+	defer os.RemoveAll(src)
+	if err := os.Chmod(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	destination := path.Join(os.TempDir(), utils.NewID())
+	if err := os.Mkdir(destination, 0750); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	// Names starting with ".." are fine, as long as they stay in the destination.
+	err := copyArtifacts(src, destination, func(artifactType, defaultRelPath string) string {
+		return "..rootfs.squash"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.FileExists(path.Join(destination, "..rootfs.squash")) {
+		t.Fatal("expected the rootfs to be copied to ..rootfs.squash")
+	}
+
+	info, err := os.Stat(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Fatalf("expected the destination to keep its mode 0750, got %v", info.Mode().Perm())
+	}
+
+	err = copyArtifacts(src, destination, func(artifactType, defaultRelPath string) string {
+		return path.Join("..", defaultRelPath)
+	})
+	if err == nil {
+		t.Fatal("expected an artifact mapped outside of the destination to be rejected")
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	root := createExtracted(t, map[string]string{
+		"darch-extract-excludes":  "/var/cache",
+		"usr/lib/modules/vmlinuz": "kernel",
+	})
+	defer os.RemoveAll(root)
+	// A file on the host, that isn't in the image.
+	host := createExtracted(t, map[string]string{
+		"shadow":            "secret",
+		"boot/vmlinuz-host": "host kernel",
+	})
+	defer os.RemoveAll(host)
+
+	for link, target := range map[string]string{
+		"excludes":      "/darch-extract-excludes",
+		"host-absolute": path.Join(host, "shadow"),
+		"host-relative": path.Join("../../../../../../..", host, "shadow"),
+		"boot":          "/usr/lib/modules",
+		"boot-host":     path.Join(host, "boot"),
+	} {
+		if err := os.Symlink(target, path.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(path.Join(root, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{"/darch-extract-excludes", "/excludes"} {
+		resolved, exists, err := imageFile(root, filePath)
+		if err != nil || !exists {
+			t.Fatalf("expected %s to exist, got %v", filePath, err)
+		}
+		if resolved != path.Join(root, "darch-extract-excludes") {
+			t.Fatalf("expected %s to be resolved in the image, got %s", filePath, resolved)
+		}
+	}
+
+	// Kernels are often symlinks to absolute paths.
+	resolved, exists, err := imageFile(root, "/boot/vmlinuz")
+	if err != nil || !exists || resolved != path.Join(root, "usr/lib/modules/vmlinuz") {
+		t.Fatalf("expected /boot/vmlinuz to be resolved to the image's kernel, got %s (%v)", resolved, err)
+	}
+
+	for _, filePath := range []string{"/missing", "/host-absolute", "/host-relative", "/boot-host/vmlinuz-host"} {
+		if _, exists, err := imageFile(root, filePath); err != nil || exists {
+			t.Fatalf("expected %s to not exist in the image, got %v (%v)", filePath, exists, err)
+		}
+	}
+
+	if _, _, err := imageFile(root, "/dir"); err == nil {
+		t.Fatal("expected a directory to be rejected")
+	}
+}
+
+// createSigningKeys Generates a gpg key pair, and exports it to dir.
+func createSigningKeys(t *testing.T, dir string) (string, string) {
+	homeDir := path.Join(dir, "gnupg")
+	if err := os.MkdirAll(homeDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	gpg := func(args ...string) []byte {
+		output, err := exec.Command("gpg", append([]string{"--batch", "--homedir", homeDir}, args...)...).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+	gpg("--passphrase", "", "--quick-gen-key", "test@darch", "default", "default", "never")
+
+	privateKeyFile := path.Join(dir, "private.asc")
+	publicKeyFile := path.Join(dir, "public.asc")
+	if err := ioutil.WriteFile(privateKeyFile, gpg("--export-secret-keys", "--armor", "test@darch"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(publicKeyFile, gpg("--export", "--armor", "test@darch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateKeyFile, publicKeyFile
+}
+
+func TestSignAndVerifyArtifacts(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+
+	keysDir := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(keysDir)
+	privateKeyFile, publicKeyFile := createSigningKeys(t, keysDir)
+
+	src := createExtracted(t, map[string]string{
+		"image.json":          `{"kernel": "vmlinuz-linux", "initramfs": "initramfs-linux.img", "rootfs": "rootfs.squash"}`,
+		"vmlinuz-linux":       "kernel",
+		"initramfs-linux.img": "initramfs",
+		"rootfs.squash":       "rootfs",
+	})
+	defer os.RemoveAll(src)
+	destination := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(destination)
+
+	// As ExtractImage does, once the files are written.
+	if err := copyArtifacts(src, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := signArtifacts(destination, privateKeyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyArtifacts(destination, publicKeyFile); err != nil {
+		t.Fatalf("expected the artifacts to be verified, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(destination, "rootfs.squash"), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifacts(destination, publicKeyFile); err == nil {
+		t.Fatal("expected a tampered rootfs to fail verification")
+	}
+}
+
+func TestExtractImagesError(t *testing.T) {
+	base, _ := reference.ParseImage("base")
+	web, _ := reference.ParseImage("web:v2")
+	gpu, _ := reference.ParseImage("gpu")
+
+	err := ExtractImagesError{
+		Total:      4,
+		Failed:     []ExtractJobError{{Job: ExtractJob{ImageRef: web}, Err: fmt.Errorf("no kernel found")}},
+		NotStarted: []ExtractJob{{ImageRef: gpu}},
+	}
+	expected := "2 of 4 images couldn't be extracted\n  web:v2: no kernel found\n  gpu:latest: not started"
+	if err.Error() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, err.Error())
+	}
+
+	for _, destinations := range [][]string{
+		{"/srv/images/base", "/srv/images/base/"},
+		{"/srv/images/base", "/srv/images/../images/base"},
+		{"/srv/images", "/srv/images/base"},
+		{"/srv/images/base", "/srv/images"},
+		{"images/base", "./images/base"},
+	} {
+		if err := verifyExtractJobs([]ExtractJob{
+			{ImageRef: base, Destination: destinations[0]},
+			{ImageRef: web, Destination: destinations[1]},
+		}); err == nil {
+			t.Fatalf("expected jobs extracted to %s and %s to be rejected", destinations[0], destinations[1])
+		}
+	}
+	if err := verifyExtractJobs([]ExtractJob{
+		{ImageRef: base, Destination: "/srv/images/base"},
+		{ImageRef: web, Destination: "/srv/images/base-web"},
+	}); err != nil {
+		t.Fatalf("expected jobs with different destinations to be valid, got %v", err)
+	}
+}
+
+func TestExtractImagesCancelled(t *testing.T) {
+	base, _ := reference.ParseImage("base")
+	web, _ := reference.ParseImage("web")
+	jobs := []ExtractJob{
+		{ImageRef: base, Destination: "/srv/images/base"},
+		{ImageRef: web, Destination: "/srv/images/web"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing is extracted (containerd isn't needed), the jobs aren't started.
+	session := &Session{runtime: &fakeRuntime{}}
+	err := session.ExtractImages(ctx, jobs, ExtractImagesOptions{})
+	extractErr, ok := err.(ExtractImagesError)
+	if !ok {
+		t.Fatalf("expected an ExtractImagesError, got %v", err)
+	}
+	if len(extractErr.Failed) != 0 || len(extractErr.NotStarted) != len(jobs) {
+		t.Fatalf("expected none of the jobs to be started, got %v", err)
+	}
+}
+
+func TestVerifyExtractOptions(t *testing.T) {
+	valid := []ExtractOptions{
+		{},
+		{SquashFS: SquashFSOptions{Compression: "zstd", CompressionLevel: 19, BlockSize: 1048576}},
+		{Format: ExtractFormatSquashFS, SquashFS: SquashFSOptions{Compression: "lz4"}},
+		{Format: ExtractFormatTar},
+	}
+	for _, opts := range valid {
+		if err := verifyExtractOptions(opts); err != nil {
+			t.Fatalf("expected %v to be valid, got %v", opts, err)
+		}
+	}
+
+	invalid := []ExtractOptions{
+		{Format: "zip"},
+		{Format: ExtractFormatTarGz, SquashFS: SquashFSOptions{Compression: "zstd"}},
+		{SquashFS: SquashFSOptions{CompressionLevel: 9}},
+		{SquashFS: SquashFSOptions{Compression: "zstd", CompressionLevel: -1}},
+		{SquashFS: SquashFSOptions{BlockSize: -1}},
+	}
+	for _, opts := range invalid {
+		if err := verifyExtractOptions(opts); err == nil {
+			t.Fatalf("expected %v to be invalid", opts)
+		}
+	}
+}
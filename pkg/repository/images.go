@@ -2,12 +2,16 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
 	"github.com/godarch/darch/pkg/reference"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -15,12 +19,24 @@ import (
 type Image struct {
 	Name      string
 	Tag       string
+	Digest    digest.Digest
 	CreatedAt time.Time
+	// Size The size of the image's content (compressed), in bytes,
+	// or SizeUnknown if some of its content is missing.
+	Size int64
+}
+
+// SizeUnknown The size of images whose size couldn't be determined.
+const SizeUnknown = -1
+
+// FullName Returns name:tag for the image.
+func (image Image) FullName() string {
+	return reference.ImageRef{Name: image.Name, Tag: image.Tag, Digest: image.Digest}.FullName()
 }
 
 // GetImages Get all the built images.
 func (session *Session) GetImages(ctx context.Context) ([]Image, error) {
-	ctx = namespaces.WithNamespace(ctx, "darch")
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
 
 	imgs, err := session.client.ImageService().List(ctx)
 	if err != nil {
@@ -33,10 +49,18 @@ func (session *Session) GetImages(ctx context.Context) ([]Image, error) {
 		if err != nil {
 			return nil, err
 		}
+		// An image with missing (or partial) content shouldn't keep the others from being listed.
+		size, err := img.Size(ctx, session.content, platforms.Default())
+		if err != nil {
+			log.Printf("couldn't get the size of %s: %v\n", ref.FullName(), err)
+			size = SizeUnknown
+		}
 		result = append(result, Image{
 			Name:      ref.Name,
 			Tag:       ref.Tag,
+			Digest:    ref.Digest,
 			CreatedAt: img.CreatedAt,
+			Size:      size,
 		})
 	}
 
@@ -45,7 +69,7 @@ func (session *Session) GetImages(ctx context.Context) ([]Image, error) {
 
 // TagImage Tag an image.
 func (session *Session) TagImage(ctx context.Context, source, destination reference.ImageRef) error {
-	ctx = namespaces.WithNamespace(ctx, "darch")
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
 
 	sourceImage, err := session.client.GetImage(ctx, source.FullName())
 	if err != nil {
@@ -53,7 +77,7 @@ func (session *Session) TagImage(ctx context.Context, source, destination refere
 	}
 
 	// Prevent garbage collection while we work.
-	ctx, done, err := session.client.WithLease(ctx)
+	ctx, done, err := session.withLease(ctx)
 	if err != nil {
 		return err
 	}
@@ -84,11 +108,13 @@ func (session *Session) TagImage(ctx context.Context, source, destination refere
 }
 
 // RemoveImage Removes an image locally.
-func (session *Session) RemoveImage(ctx context.Context, image string) error {
-	ctx = namespaces.WithNamespace(ctx, "darch")
-	ref, err := reference.ParseImage(image)
-	if err != nil {
-		return err
+// The delete waits for garbage collection, so that the content and
+// snapshots that only the image used are removed by the time we return.
+func (session *Session) RemoveImage(ctx context.Context, imageRef reference.ImageRef) error {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
+	err := session.client.ImageService().Delete(ctx, imageRef.FullName(), images.SynchronousDelete())
+	if err != nil && errors.Cause(err) == errdefs.ErrNotFound {
+		return fmt.Errorf("image %s doesn't exist", imageRef.FullName())
 	}
-	return session.client.ImageService().Delete(ctx, ref.FullName(), images.SynchronousDelete())
+	return err
 }
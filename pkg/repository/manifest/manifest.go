@@ -128,7 +128,7 @@ func (m *manifestImpl) AddLayer(ctx context.Context, contentStore content.Store,
 	newDesc.Size = int64(len(manifestBytes))
 	if err := content.WriteBlob(ctx,
 		contentStore,
-		"custom-ref",
+		"darch-manifest-"+newDesc.Digest.String(),
 		bytes.NewReader(manifestBytes),
 		newDesc.Size,
 		newDesc.Digest,
@@ -188,7 +188,7 @@ func patchImageConfig(ctx context.Context, contentStore content.Store, imageConf
 	result.Digest = digest.FromBytes(p)
 	result.Size = int64(len(p))
 	err = content.WriteBlob(ctx, contentStore,
-		"custom-ref",
+		"darch-config-"+result.Digest.String(),
 		bytes.NewReader(p),
 		result.Size,
 		result.Digest,
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"log"
+)
+
+// The stages of a build, in the order they happen.
+const (
+	BuildStageMountSetup      = "mount-setup"
+	BuildStageContainerCreate = "container-create"
+	BuildStageScriptRun       = "script-run"
+	BuildStageCleanup         = "cleanup"
+	BuildStageCommit          = "commit"
+	// BuildStageUpToDate The recipe didn't need to be built.
+	BuildStageUpToDate = "up-to-date"
+)
+
+// ProgressHandler Is told about each stage of a build, as it starts.
+// When building recipes concurrently, it is called from multiple goroutines.
+type ProgressHandler interface {
+	OnStage(recipeName string, stage string)
+}
+
+// ProgressHandlerFunc Allows a function to be used as a ProgressHandler.
+type ProgressHandlerFunc func(recipeName string, stage string)
+
+// OnStage Calls the function.
+func (f ProgressHandlerFunc) OnStage(recipeName string, stage string) {
+	f(recipeName, stage)
+}
+
+// logProgressHandler The handler used when none is given, it logs every stage.
+type logProgressHandler struct{}
+
+func (logProgressHandler) OnStage(recipeName string, stage string) {
+	if stage == BuildStageUpToDate {
+		log.Printf("%s is up to date, skipping build\n", recipeName)
+		return
+	}
+	log.Printf("%s: %s\n", recipeName, stage)
+}
+
+func progressOrDefault(progress ProgressHandler) ProgressHandler {
+	if progress == nil {
+		return logProgressHandler{}
+	}
+	return progress
+}
@@ -2,18 +2,23 @@ package repository
 
 import (
 	"context"
-	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/remotes"
 
+	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/godarch/darch/pkg/reference"
 )
 
-// Pull Pulls an image locally.
-func (session *Session) Pull(ctx context.Context, imageRef reference.ImageRef, resolver remotes.Resolver) error {
-	_, err := session.client.Pull(namespaces.WithNamespace(ctx, "darch"),
+// PullImage Pulls an image locally.
+func (session *Session) PullImage(ctx context.Context, imageRef reference.ImageRef, opts PullOptions) error {
+	resolver := newResolver(opts.RegistryOptions)
+	if opts.TrustPolicy != nil {
+		resolver = trustedResolver{Resolver: resolver, policy: opts.TrustPolicy, imageRef: imageRef}
+	}
+	_, err := session.client.Pull(namespaces.WithNamespace(ctx, session.namespace),
 		imageRef.FullName(),
 		containerd.WithResolver(resolver),
+		containerd.WithImageHandler(progressHandler(opts.Progress, "fetching")),
+		containerd.WithPullSnapshotter(session.snapshotterName),
 		containerd.WithPullUnpack)
-	return err
+	return registryError(err, imageRef)
 }
@@ -2,23 +2,29 @@ package repository
 
 import (
 	"context"
-	"github.com/containerd/containerd"
+	"fmt"
 
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/remotes"
 	"github.com/godarch/darch/pkg/reference"
+	"github.com/pkg/errors"
 )
 
-// Push Push an image remotely.
-func (session *Session) Push(ctx context.Context, imageRef reference.ImageRef, resolver remotes.Resolver) error {
-	ctx = namespaces.WithNamespace(ctx, "darch")
+// PushImage Push an image remotely.
+func (session *Session) PushImage(ctx context.Context, imageRef reference.ImageRef, opts PushOptions) error {
+	ctx = namespaces.WithNamespace(ctx, session.namespace)
 	image, err := session.client.GetImage(ctx, imageRef.FullName())
 	if err != nil {
+		if errors.Cause(err) == errdefs.ErrNotFound {
+			return fmt.Errorf("image %s doesn't exist locally", imageRef.FullName())
+		}
 		return err
 	}
 	err = session.client.Push(ctx,
 		image.Name(),
 		image.Target(),
-		containerd.WithResolver(resolver))
-	return err
+		containerd.WithResolver(newResolver(opts.RegistryOptions)),
+		containerd.WithImageHandler(progressHandler(opts.Progress, "pushing")))
+	return registryError(err, imageRef)
 }
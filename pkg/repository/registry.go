@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/godarch/darch/pkg/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// RegistryOptions How to connect to a remote registry.
+type RegistryOptions struct {
+	// Username The user to authenticate with, if any.
+	Username string
+	// Password The password of the user. If no user is given,
+	// this is used as a refresh token for the authorization server.
+	Password string
+	// PlainHTTP Allow connections using plain HTTP.
+	PlainHTTP bool
+	// SkipVerify Skip SSL certificate validation.
+	SkipVerify bool
+}
+
+// PushOptions Options used when pushing images.
+type PushOptions struct {
+	RegistryOptions
+	// Progress Where to report each blob as it is pushed. Optional.
+	Progress io.Writer
+}
+
+// PullOptions Options used when pulling images.
+type PullOptions struct {
+	RegistryOptions
+	// Progress Where to report each blob as it is fetched. Optional.
+	Progress io.Writer
+	// TrustPolicy Only pull the image if the policy trusts it. Optional.
+	TrustPolicy *TrustPolicy
+}
+
+func newResolver(opts RegistryOptions) remotes.Resolver {
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: opts.SkipVerify,
+		},
+		ExpectContinueTimeout: 5 * time.Second,
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		PlainHTTP: opts.PlainHTTP,
+		Credentials: func(host string) (string, string, error) {
+			// Only one host
+			return opts.Username, opts.Password, nil
+		},
+		Client: &http.Client{
+			Transport: tr,
+		},
+	})
+}
+
+// progressHandler Reports every descriptor that is dispatched.
+func progressHandler(w io.Writer, action string) images.Handler {
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if w != nil {
+			fmt.Fprintf(w, "%s %s %s (%d bytes)\n", action, desc.MediaType, desc.Digest, desc.Size)
+		}
+		return nil, nil
+	})
+}
+
+// registryError Makes the errors returned by the registry a bit more meaningful.
+func registryError(err error, imageRef reference.ImageRef) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Cause(err) == errdefs.ErrNotFound {
+		return errors.Wrapf(err, "%s doesn't exist in the registry", imageRef.FullName())
+	}
+	// The resolver doesn't give us typed errors for failed authentication.
+	message := err.Error()
+	if strings.Contains(message, "401 Unauthorized") || strings.Contains(message, "403 Forbidden") {
+		return errors.Wrapf(err, "authentication with the registry failed for %s", imageRef.FullName())
+	}
+	return err
+}
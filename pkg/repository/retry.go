@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryBackoff How long to wait before the first retry, doubling after each one.
+var retryBackoff = 2 * time.Second
+
+// withRetries Runs the operation, retrying it (with backoff) up to the given
+// number of times if it fails. Should only be used for operations that are
+// safe to run more than once. Returns the last error if every attempt fails.
+// Untrusted images aren't retried, they won't become trusted.
+func withRetries(ctx context.Context, retries int, description string, operation func() error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		if _, ok := errors.Cause(err).(UntrustedImageError); ok {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		log.Printf("error %s (attempt %d of %d), retrying in %s: %v\n", description, attempt+1, retries+1, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWithRetries(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	attempts := 0
+	err := withRetries(context.Background(), 3, "testing", func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("flaky")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("should have succeeded after retrying, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	err = withRetries(context.Background(), 2, "testing", func() error {
+		attempts++
+		return fmt.Errorf("attempt %d", attempts)
+	})
+	if err == nil || err.Error() != "attempt 3" {
+		t.Fatalf("expected the last error, got %v", err)
+	}
+
+	attempts = 0
+	withRetries(context.Background(), 0, "testing", func() error {
+		attempts++
+		return fmt.Errorf("broken")
+	})
+	if attempts != 1 {
+		t.Fatal("shouldn't retry by default")
+	}
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/image-spec/identity"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// containerRun A container to run on a snapshot of an image, until it exits.
+type containerRun struct {
+	img         containerd.Image
+	snapshotKey string
+	env         []string
+	mounts      []specs.Mount
+	args        []string
+	stdout      io.Writer
+	stderr      io.Writer
+}
+
+// containerRuntime What builds and extractions do with containerd, besides working
+// with images. Sessions use containerd itself (see containerdRuntime), tests
+// replace it, so that the steps of a build can be checked without containerd.
+type containerRuntime interface {
+	// createLease Creates a lease, returning a context that holds it,
+	// and a function that deletes it.
+	createLease(ctx context.Context) (context.Context, func() error, error)
+	// createSnapshot Creates an active snapshot of the (unpacked) image.
+	createSnapshot(ctx context.Context, snapshotKey string, img containerd.Image) error
+	deleteSnapshot(ctx context.Context, snapshotKey string) error
+	// runContainer Runs the container until it exits. The container (and its task)
+	// are deleted when it does, or when ctx is cancelled.
+	runContainer(ctx context.Context, run containerRun) error
+}
+
+// containerdRuntime Runs everything with the containerd of the session.
+type containerdRuntime struct {
+	session *Session
+}
+
+func (r containerdRuntime) createLease(ctx context.Context) (context.Context, func() error, error) {
+	lease, err := r.session.client.CreateLease(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = leases.WithLease(ctx, lease.ID())
+	return ctx, func() error {
+		return lease.Delete(cleanupContext(ctx))
+	}, nil
+}
+
+func (r containerdRuntime) createSnapshot(ctx context.Context, snapshotKey string, img containerd.Image) error {
+	// The image may have been unpacked to another snapshotter.
+	unpacked, err := img.IsUnpacked(ctx, r.session.snapshotterName)
+	if err != nil {
+		return err
+	}
+	if !unpacked {
+		if err = img.Unpack(ctx, r.session.snapshotterName); err != nil {
+			return err
+		}
+	}
+
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return err
+	}
+	parent := identity.ChainID(diffIDs).String()
+	if _, err := r.session.snapshotter.Prepare(ctx, snapshotKey, parent); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r containerdRuntime) deleteSnapshot(ctx context.Context, snapshotKey string) error {
+	return r.session.snapshotter.Remove(ctx, snapshotKey)
+}
+
+func (r containerdRuntime) runContainer(ctx context.Context, run containerRun) error {
+	return r.session.RunContainer(ctx, ContainerConfig{
+		newOpts: []containerd.NewContainerOpts{
+			containerd.WithImage(run.img),
+			containerd.WithSnapshotter(r.session.snapshotterName),
+			containerd.WithSnapshot(run.snapshotKey),
+			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
+			containerd.WithNewSpec(
+				oci.WithImageConfig(run.img),
+				oci.WithEnv(run.env),
+				oci.WithHostNamespace(specs.NetworkNamespace),
+				oci.WithMounts(run.mounts),
+				oci.WithProcessArgs(run.args...),
+			),
+		},
+		stdout: run.stdout,
+		stderr: run.stderr,
+	})
+}
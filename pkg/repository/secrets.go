@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/godarch/darch/pkg/utils"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// BuildSecret A file (or directory) on the host that is mounted (read-only) into
+// the container while the recipe scripts run. Secrets are never committed to the
+// image, nor are the files and directories created to mount them on.
+type BuildSecret struct {
+	// Source The path on the host.
+	Source string
+	// Target The absolute path in the container.
+	Target string
+}
+
+// ParseBuildSecret Parses a secret given as source:target.
+func ParseBuildSecret(val string) (BuildSecret, error) {
+	split := strings.SplitN(val, ":", 2)
+	if len(split) != 2 || len(split[0]) == 0 || len(split[1]) == 0 {
+		return BuildSecret{}, fmt.Errorf("invalid secret %q, expected source:target", val)
+	}
+	return BuildSecret{Source: split[0], Target: split[1]}, nil
+}
+
+// secretMounts Returns the mounts for the secrets, making sure they can be mounted.
+func secretMounts(secrets []BuildSecret) ([]specs.Mount, error) {
+	mounts := make([]specs.Mount, 0, len(secrets))
+	for _, secret := range secrets {
+		target := path.Clean(secret.Target)
+		if !path.IsAbs(target) || target == "/" {
+			return nil, fmt.Errorf("invalid target %s for secret %s, it must be an absolute path", secret.Target, secret.Source)
+		}
+		source := utils.ExpandPath(secret.Source)
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("secret %s doesn't exist", secret.Source)
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: target,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", "ro"},
+		})
+	}
+	return mounts, nil
+}
+
+// secretMountPoint A secret that is mounted on a path that doesn't exist in the image.
+type secretMountPoint struct {
+	// target Where the secret is mounted.
+	target string
+	// created The first directory on the way to target (or target itself) that
+	// didn't exist, and is created to mount the secret on.
+	created string
+}
+
+// secretMountPoints Returns the secrets whose mount points will be
+// created in the snapshot, so they can be removed afterwards.
+func (session *Session) secretMountPoints(ctx context.Context, snapshotKey string, mounts []specs.Mount) ([]secretMountPoint, error) {
+	if len(mounts) == 0 {
+		return nil, nil
+	}
+
+	snapshotMounts, err := session.snapshotter.Mounts(ctx, snapshotKey)
+	if err != nil {
+		return nil, err
+	}
+
+	created := []secretMountPoint{}
+	err = mount.WithTempMount(ctx, snapshotMounts, func(root string) error {
+		for _, m := range mounts {
+			missing, err := firstMissingPath(root, m.Destination)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				created = append(created, secretMountPoint{target: m.Destination, created: missing})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// removeSecretMountPoints Removes the paths created to mount the secrets on.
+func (session *Session) removeSecretMountPoints(ctx context.Context, snapshotKey string, mountPoints []secretMountPoint) error {
+	if len(mountPoints) == 0 {
+		return nil
+	}
+
+	snapshotMounts, err := session.snapshotter.Mounts(ctx, snapshotKey)
+	if err != nil {
+		return err
+	}
+
+	return mount.WithTempMount(ctx, snapshotMounts, func(root string) error {
+		for _, mountPoint := range mountPoints {
+			if err := removeMountPoint(root, mountPoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeMountPoint Removes the (empty) file or directory the secret was mounted on, and
+// then the directories created for it, deepest first. The scripts may have written
+// other files to those directories, so they are only removed while they are empty.
+func removeMountPoint(root string, mountPoint secretMountPoint) error {
+	if err := os.Remove(path.Join(root, mountPoint.target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if mountPoint.target == mountPoint.created {
+		return nil
+	}
+	for dir := path.Dir(mountPoint.target); dir != "/"; dir = path.Dir(dir) {
+		if err := os.Remove(path.Join(root, dir)); err != nil && !os.IsNotExist(err) {
+			// Not empty, it (and its parents) are kept.
+			return nil
+		}
+		if dir == mountPoint.created {
+			break
+		}
+	}
+	return nil
+}
+
+// firstMissingPath Returns the first path (from the root down) on the way to target that
+// doesn't exist in root, or an empty string if target already exists.
+// Paths that go through symlinks aren't allowed, since they are resolved in the container.
+func firstMissingPath(root string, target string) (string, error) {
+	current := "/"
+	for _, component := range strings.Split(strings.Trim(target, "/"), "/") {
+		current = path.Join(current, component)
+		info, err := os.Lstat(path.Join(root, current))
+		if os.IsNotExist(err) {
+			return current, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("can't mount a secret at %s, %s is a symlink", target, current)
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+func TestFirstMissingPath(t *testing.T) {
+	root := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(path.Join(root, "etc", "pacman.d"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/run", path.Join(root, "var")); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, expected := range map[string]string{
+		"/etc/pacman.d":           "",
+		"/etc/pacman.d/token":     "/etc/pacman.d/token",
+		"/root/.ssh/deploy_key":   "/root",
+		"/etc/pacman.d/keys/key/": "/etc/pacman.d/keys",
+	} {
+		mountPoint, err := firstMissingPath(root, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mountPoint != expected {
+			t.Fatalf("expected %q to be created for %s, got %q", expected, target, mountPoint)
+		}
+	}
+
+	if _, err := firstMissingPath(root, "/var/secret"); err == nil {
+		t.Fatal("expected secrets mounted through symlinks to be rejected")
+	}
+}
+
+func TestParseBuildSecret(t *testing.T) {
+	secret, err := ParseBuildSecret("~/.ssh/deploy_key:/root/.ssh/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Source != "~/.ssh/deploy_key" || secret.Target != "/root/.ssh/id_rsa" {
+		t.Fatalf("unexpected secret %v", secret)
+	}
+	for _, val := range []string{"", "source", ":target", "source:"} {
+		if _, err = ParseBuildSecret(val); err == nil {
+			t.Fatalf("expected %q to be invalid", val)
+		}
+	}
+}
+
+func TestRemoveMountPointKeepsWhatScriptsWrote(t *testing.T) {
+	root := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(root)
+
+	// /root/.ssh was created to mount /root/.ssh/id_rsa on, and the script added known_hosts.
+	if err := os.MkdirAll(path.Join(root, "root", ".ssh"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"id_rsa", "known_hosts"} {
+		if err := ioutil.WriteFile(path.Join(root, "root", ".ssh", file), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// /etc/pacman.d/token had nothing written next to it.
+	if err := os.MkdirAll(path.Join(root, "etc", "pacman.d"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "etc", "pacman.d", "token"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeMountPoint(root, secretMountPoint{target: "/root/.ssh/id_rsa", created: "/root"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeMountPoint(root, secretMountPoint{target: "/etc/pacman.d/token", created: "/etc/pacman.d"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if utils.FileExists(path.Join(root, "root", ".ssh", "id_rsa")) {
+		t.Fatal("the mount point wasn't removed")
+	}
+	if !utils.FileExists(path.Join(root, "root", ".ssh", "known_hosts")) {
+		t.Fatal("what the script wrote was removed")
+	}
+	if utils.DirectoryExists(path.Join(root, "etc", "pacman.d")) {
+		t.Fatal("the empty directory created for the secret wasn't removed")
+	}
+	if !utils.DirectoryExists(path.Join(root, "etc")) {
+		t.Fatal("a directory that existed before was removed")
+	}
+}
@@ -1,11 +1,15 @@
 package repository
 
 import (
+	"fmt"
+
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -13,6 +17,9 @@ var (
 	DefaultContainerdSocketLocation = "/var/run/containerd/containerd.sock"
 )
 
+// DefaultNamespace The containerd namespace images are kept in, unless another is given.
+const DefaultNamespace = "darch"
+
 // Session An object that represent a session to a containerd runtime.
 type Session struct {
 	client      *containerd.Client
@@ -20,24 +27,72 @@ type Session struct {
 	imagesStore images.Store
 	differ      diff.Differ
 	content     content.Store
+	namespace   string
+	// snapshotterName The snapshotter that images are unpacked to, and containers ran from.
+	snapshotterName string
+	// runtime What leases, snapshots and containers are created with.
+	runtime containerRuntime
+}
+
+// SessionOpt An option used when creating a session.
+type SessionOpt func(session *Session) error
+
+// WithNamespace Use the given containerd namespace, instead of DefaultNamespace.
+// Sessions with different namespaces don't see each others images.
+func WithNamespace(namespace string) SessionOpt {
+	return func(session *Session) error {
+		if err := namespaces.Validate(namespace); err != nil {
+			return err
+		}
+		session.namespace = namespace
+		return nil
+	}
+}
+
+// WithSnapshotterName Use the given containerd snapshotter (btrfs, etc),
+// instead of containerd's default one.
+func WithSnapshotterName(snapshotterName string) SessionOpt {
+	return func(session *Session) error {
+		if len(snapshotterName) == 0 {
+			return fmt.Errorf("no snapshotter provided")
+		}
+		session.snapshotterName = snapshotterName
+		return nil
+	}
 }
 
 // NewSession creates a new session
-func NewSession(containerdSocket string) (*Session, error) {
+func NewSession(containerdSocket string, opts ...SessionOpt) (*Session, error) {
 	client, err := containerd.New(containerdSocket)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "couldn't connect to containerd at %s", containerdSocket)
+	}
+
+	session := &Session{
+		client:          client,
+		imagesStore:     client.ImageService(),
+		differ:          client.DiffService(),
+		content:         client.ContentStore(),
+		namespace:       DefaultNamespace,
+		snapshotterName: containerd.DefaultSnapshotter,
 	}
 
-	client.ImageService()
+	for _, opt := range opts {
+		if err = opt(session); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	session.snapshotter = client.SnapshotService(session.snapshotterName)
+	session.runtime = containerdRuntime{session: session}
+
+	return session, nil
+}
 
-	return &Session{
-		client:      client,
-		snapshotter: client.SnapshotService(containerd.DefaultSnapshotter),
-		imagesStore: client.ImageService(),
-		differ:      client.DiffService(),
-		content:     client.ContentStore(),
-	}, nil
+// Namespace The containerd namespace the session works in.
+func (session *Session) Namespace() string {
+	return session.namespace
 }
 
 // Close Closes the session.
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/remotes"
+	"github.com/godarch/darch/pkg/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TrustPolicy Decides which external images recipes may be built on.
+type TrustPolicy struct {
+	// TrustedDigests The manifest digests of the external images we trust.
+	TrustedDigests []digest.Digest
+}
+
+// UntrustedImageError An external image that isn't trusted by the policy.
+type UntrustedImageError struct {
+	ImageRef reference.ImageRef
+	Digest   digest.Digest
+}
+
+func (e UntrustedImageError) Error() string {
+	return fmt.Sprintf("external image %s (%s) isn't trusted", e.ImageRef.FullName(), e.Digest)
+}
+
+// ParseTrustPolicy Creates a trust policy from a list of digests (sha256:...).
+func ParseTrustPolicy(trustedDigests []string) (*TrustPolicy, error) {
+	policy := &TrustPolicy{}
+	for _, trustedDigest := range trustedDigests {
+		d, err := digest.Parse(trustedDigest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted digest %s: %v", trustedDigest, err)
+		}
+		policy.TrustedDigests = append(policy.TrustedDigests, d)
+	}
+	return policy, nil
+}
+
+// Verify Returns an error if the image isn't trusted by the policy.
+func (policy *TrustPolicy) Verify(imageRef reference.ImageRef, img containerd.Image) error {
+	return policy.verifyDigest(imageRef, img.Target().Digest)
+}
+
+func (policy *TrustPolicy) verifyDigest(imageRef reference.ImageRef, target digest.Digest) error {
+	for _, trustedDigest := range policy.TrustedDigests {
+		if trustedDigest == target {
+			return nil
+		}
+	}
+	return UntrustedImageError{ImageRef: imageRef, Digest: target}
+}
+
+// trustedResolver Only resolves the images the policy trusts. Pulls fetch
+// what the reference resolved to, so an untrusted image is rejected before
+// any of it is fetched (or unpacked).
+type trustedResolver struct {
+	remotes.Resolver
+	policy   *TrustPolicy
+	imageRef reference.ImageRef
+}
+
+func (r trustedResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	name, desc, err := r.Resolver.Resolve(ctx, ref)
+	if err != nil {
+		return name, desc, err
+	}
+	if err = r.policy.verifyDigest(r.imageRef, desc.Digest); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	return name, desc, nil
+}
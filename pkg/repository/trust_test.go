@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/godarch/darch/pkg/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// fakeResolver Resolves every reference to the same manifest, and can't fetch anything.
+type fakeResolver struct {
+	remotes.Resolver
+	digest digest.Digest
+}
+
+func (r fakeResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: r.digest}, nil
+}
+
+func TestTrustedResolver(t *testing.T) {
+	trusted := digest.FromString("trusted")
+	policy, err := ParseTrustPolicy([]string{trusted.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageRef, _ := reference.ParseImage("docker.io/library/archlinux:latest")
+
+	resolver := trustedResolver{Resolver: fakeResolver{digest: trusted}, policy: policy, imageRef: imageRef}
+	if _, desc, err := resolver.Resolve(context.Background(), imageRef.FullName()); err != nil || desc.Digest != trusted {
+		t.Fatalf("expected the trusted image to be resolved, got %v", err)
+	}
+
+	resolver = trustedResolver{Resolver: fakeResolver{digest: digest.FromString("untrusted")}, policy: policy, imageRef: imageRef}
+	_, _, err = resolver.Resolve(context.Background(), imageRef.FullName())
+	if _, ok := err.(UntrustedImageError); !ok {
+		t.Fatalf("expected the untrusted image to be rejected before it is fetched, got %v", err)
+	}
+
+	// Pulls wrap the error of the resolver.
+	attempts := 0
+	withRetries(context.Background(), 3, "testing", func() error {
+		attempts++
+		return errors.Wrapf(err, "failed to resolve reference %q", imageRef.FullName())
+	})
+	if attempts != 1 {
+		t.Fatalf("expected an untrusted image not to be retried, got %d attempts", attempts)
+	}
+}
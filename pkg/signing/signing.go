@@ -0,0 +1,102 @@
+package signing
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+// SignatureExtension The extension of the detached signature written next to each signed file.
+const SignatureExtension = ".sig"
+
+// SignFiles Writes a detached signature (file + SignatureExtension) for each
+// of the files, using the private key in keyFile. The key can't have a passphrase.
+func SignFiles(keyFile string, files []string) error {
+	homeDir, err := newHomeDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(homeDir)
+
+	if err = importKey(homeDir, keyFile); err != nil {
+		return fmt.Errorf("couldn't load the private key %s: %v", keyFile, err)
+	}
+
+	secretKeys, err := runGpg(homeDir, "--list-secret-keys", "--with-colons")
+	if err != nil {
+		return fmt.Errorf("couldn't load the private key %s: %v", keyFile, err)
+	}
+	if !strings.HasPrefix(secretKeys, "sec:") && !strings.Contains(secretKeys, "\nsec:") {
+		return fmt.Errorf("couldn't load the private key %s: it doesn't contain a private key", keyFile)
+	}
+
+	for _, file := range files {
+		_, err = runGpg(homeDir, "--pinentry-mode", "loopback", "--passphrase", "", "--detach-sign", "--output", file+SignatureExtension, file)
+		if err != nil {
+			return fmt.Errorf("couldn't sign %s: %v", file, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyFiles Verifies the detached signature of each of the
+// files was made by the key in publicKeyFile.
+func VerifyFiles(publicKeyFile string, files []string) error {
+	homeDir, err := newHomeDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(homeDir)
+
+	if err = importKey(homeDir, publicKeyFile); err != nil {
+		return fmt.Errorf("couldn't load the public key %s: %v", publicKeyFile, err)
+	}
+
+	for _, file := range files {
+		signature := file + SignatureExtension
+		if !utils.FileExists(signature) {
+			return fmt.Errorf("%s has no signature (%s)", file, signature)
+		}
+		if _, err = runGpg(homeDir, "--verify", signature, file); err != nil {
+			return fmt.Errorf("the signature of %s couldn't be verified: %v", file, err)
+		}
+	}
+
+	return nil
+}
+
+// newHomeDir Creates an empty gpg home directory, so that only the keys
+// we are given are used, not the keys of whoever is running us.
+func newHomeDir() (string, error) {
+	return ioutil.TempDir("", "darch-gpg")
+}
+
+func importKey(homeDir string, keyFile string) error {
+	if !utils.FileExists(keyFile) {
+		return fmt.Errorf("the file doesn't exist")
+	}
+	_, err := runGpg(homeDir, "--import", keyFile)
+	return err
+}
+
+func runGpg(homeDir string, args ...string) (string, error) {
+	cmd := exec.Command("gpg", append([]string{"--batch", "--yes", "--no-tty", "--homedir", homeDir}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); len(message) > 0 {
+			return "", fmt.Errorf("%v: %s", err, message)
+		}
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,79 @@
+package signing
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/godarch/darch/pkg/utils"
+)
+
+// createKeys Generates a key pair, and exports it to dir.
+func createKeys(t *testing.T, dir string) (string, string) {
+	homeDir := path.Join(dir, "gnupg")
+	if err := os.MkdirAll(homeDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runGpg(homeDir, "--passphrase", "", "--quick-gen-key", "test@darch", "default", "default", "never"); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := runGpg(homeDir, "--export-secret-keys", "--armor", "test@darch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := runGpg(homeDir, "--export", "--armor", "test@darch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKeyFile := path.Join(dir, "private.asc")
+	publicKeyFile := path.Join(dir, "public.asc")
+	if err = ioutil.WriteFile(privateKeyFile, []byte(privateKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(publicKeyFile, []byte(publicKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateKeyFile, publicKeyFile
+}
+
+func TestSignAndVerify(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+
+	dir := path.Join(os.TempDir(), utils.NewID())
+	defer os.RemoveAll(dir)
+	privateKeyFile, publicKeyFile := createKeys(t, dir)
+
+	file := path.Join(dir, "rootfs.squash")
+	if err := ioutil.WriteFile(file, []byte("rootfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SignFiles(privateKeyFile, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFiles(publicKeyFile, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tampered with.
+	if err := ioutil.WriteFile(file, []byte("rootfs!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFiles(publicKeyFile, []string{file}); err == nil {
+		t.Fatal("expected the signature of a modified file to be rejected")
+	}
+
+	// A public key can't sign.
+	if err := SignFiles(publicKeyFile, []string{file}); err == nil {
+		t.Fatal("expected an error signing with a public key")
+	}
+	if err := SignFiles(path.Join(dir, "missing.asc"), []string{file}); err == nil {
+		t.Fatal("expected an error signing with a missing key")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"strings"
 )
 
 var (
@@ -17,8 +18,37 @@ var (
 	DefaultGrubConfigPath = "/etc/darch/grub.cfg"
 )
 
-// PrintGrubMenuEntry Print the grub entry for the given staged image.
+// PrintGrubMenuEntry Print the grub entries for the given staged image.
+// There is an entry for the default kernel, and one for every other kernel flavor.
 func (session *Session) PrintGrubMenuEntry(stagedImage StagedImageNamed, output io.Writer) error {
+	err := session.printGrubMenuEntryForKernel(stagedImage,
+		fmt.Sprintf("Darch - %s", stagedImage.Ref.FullName()),
+		stagedImage.Kernel,
+		stagedImage.InitRAMFS,
+		output)
+	if err != nil {
+		return err
+	}
+
+	for _, kernel := range stagedImage.Kernels {
+		if kernel.Kernel == stagedImage.Kernel {
+			// Already printed as the default entry.
+			continue
+		}
+		err = session.printGrubMenuEntryForKernel(stagedImage,
+			fmt.Sprintf("Darch - %s (%s)", stagedImage.Ref.FullName(), kernel.Flavor),
+			kernel.Kernel,
+			kernel.InitRAMFS,
+			output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (session *Session) printGrubMenuEntryForKernel(stagedImage StagedImageNamed, name string, kernel string, initRAMFS string, output io.Writer) error {
 	device, err := block.GetBlockDeviceForPath(stagedImage.Dir)
 	if err != nil {
 		return err
@@ -33,14 +63,21 @@ func (session *Session) PrintGrubMenuEntry(stagedImage StagedImageNamed, output
 	}
 	commandLine := fmt.Sprintf("darch_rootfs=%s darch_dir=UUID=%s:%s", stagedImage.RootFS, uuid, relPathTodevice)
 
-	return grub.MenuEntry(fmt.Sprintf("Darch - %s", stagedImage.Ref.FullName()), func(w io.Writer) error {
+	// Grub loads multiple initrds in order, microcode must come first.
+	initrds := []string{}
+	for _, ucode := range stagedImage.Ucode {
+		initrds = append(initrds, path.Join(relPathTodevice, ucode))
+	}
+	initrds = append(initrds, path.Join(relPathTodevice, initRAMFS))
+
+	return grub.MenuEntry(name, func(w io.Writer) error {
 		err := grub.PrepareAccessToDevice(device, w)
 		if err != nil {
 			return err
 		}
-		err = grub.LoadLinux(path.Join(relPathTodevice, stagedImage.Kernel),
+		err = grub.LoadLinux(path.Join(relPathTodevice, kernel),
 			commandLine,
-			path.Join(relPathTodevice, stagedImage.InitRAMFS),
+			strings.Join(initrds, " "),
 			w)
 		if err != nil {
 			return err
@@ -16,6 +16,18 @@ type StagedImage struct {
 	Kernel    string
 	InitRAMFS string
 	RootFS    string
+	// Ucode Microcode images, loaded before the initramfs.
+	Ucode []string
+	// Kernels All the kernel flavors in the image, including the default one.
+	Kernels []StagedKernel
+}
+
+// StagedKernel A kernel flavor (linux, linux-lts, etc) of a staged image.
+type StagedKernel struct {
+	Flavor    string
+	Version   string
+	Kernel    string
+	InitRAMFS string
 }
 
 // StagedImageNamed A StagedImage with a name and tag
@@ -25,9 +37,18 @@ type StagedImageNamed struct {
 }
 
 type stagedImageConfiguration struct {
+	Kernel    string                      `json:"kernel"`
+	InitRAMFS string                      `json:"initramfs"`
+	RootFS    string                      `json:"rootfs"`
+	Ucode     []string                    `json:"ucode"`
+	Kernels   []stagedKernelConfiguration `json:"kernels"`
+}
+
+type stagedKernelConfiguration struct {
+	Flavor    string `json:"flavor"`
+	Version   string `json:"version"`
 	Kernel    string `json:"kernel"`
 	InitRAMFS string `json:"initramfs"`
-	RootFS    string `json:"rootfs"`
 }
 
 // ParseImageDir Parses an image directory, and also validates it.
@@ -68,9 +89,31 @@ func parseImageDir(imageDir string) (StagedImage, error) {
 		return result, fmt.Errorf("rootfs was invalid")
 	}
 
+	for _, ucode := range config.Ucode {
+		if !utils.FileExists(path.Join(imageDir, ucode)) {
+			return result, fmt.Errorf("ucode %s was invalid", ucode)
+		}
+	}
+
+	for _, kernel := range config.Kernels {
+		if !utils.FileExists(path.Join(imageDir, kernel.Kernel)) {
+			return result, fmt.Errorf("kernel %s was invalid", kernel.Flavor)
+		}
+		if !utils.FileExists(path.Join(imageDir, kernel.InitRAMFS)) {
+			return result, fmt.Errorf("initramfs for kernel %s was invalid", kernel.Flavor)
+		}
+		result.Kernels = append(result.Kernels, StagedKernel{
+			Flavor:    kernel.Flavor,
+			Version:   kernel.Version,
+			Kernel:    kernel.Kernel,
+			InitRAMFS: kernel.InitRAMFS,
+		})
+	}
+
 	result.InitRAMFS = config.InitRAMFS
 	result.Kernel = config.Kernel
 	result.RootFS = config.RootFS
+	result.Ucode = config.Ucode
 
 	return result, nil
 }
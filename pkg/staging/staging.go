@@ -2,6 +2,8 @@ package staging
 
 import (
 	"path"
+
+	"github.com/godarch/darch/pkg/reference"
 )
 
 var (
@@ -15,6 +17,15 @@ var (
 	DefaultStagingImagesFile = path.Join(DefaultStagingDirectory, "images.json")
 )
 
+// GetImageDir Get the directory of a staged image.
+func (session *Session) GetImageDir(imageRef reference.ImageRef) (string, error) {
+	association, err := session.imageStore.Get(imageRef)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(session.imagesDir, association.ID), nil
+}
+
 // GetAllStaged Get all the staged items in the given directory.
 func (session *Session) GetAllStaged() ([]StagedImageNamed, error) {
 	result := []StagedImageNamed{}
@@ -1,5 +1,9 @@
 package utils
 
+import (
+	"strings"
+)
+
 // Reverse Reverses the array
 func Reverse(elements []string) []string {
 	for i := len(elements)/2 - 1; i >= 0; i-- {
@@ -38,3 +42,13 @@ func Contains(arr []string, val string) bool {
 	}
 	return false
 }
+
+// ShellQuote Quotes the arguments so that a shell sees each one
+// as a single word, no matter what characters they contain.
+func ShellQuote(args ...string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	args := []string{"my recipe", "it's", "$HOME", "a\"b", ""}
+	output, err := exec.Command("bash", "-c", "printf '%s\\n' "+ShellQuote(args...)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "my recipe\nit's\n$HOME\na\"b\n\n"
+	if string(output) != expected {
+		t.Fatalf("expected %q, got %q", expected, output)
+	}
+}